@@ -0,0 +1,80 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strings"
+)
+
+// AccessRule allows or denies the clients connecting from a network
+type AccessRule struct {
+	Allow   bool
+	Network *net.IPNet // nil for matching all the clients ("all")
+}
+
+// parseAccessRules parses a list of access rules separated by commas,
+// each one being "allow" or "deny" followed by an IP address, CIDR or "all" ("allow 10.0.0.0/8, deny all")
+func parseAccessRules(value string) (rules []*AccessRule, err error) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		rule, err := parseAccessRule(entry)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func parseAccessRule(entry string) (*AccessRule, error) {
+	fields := strings.Fields(strings.ToLower(entry))
+	if len(fields) != 2 || (fields[0] != "allow" && fields[0] != "deny") {
+		return nil, fmt.Errorf("invalid access rule \"%s\", must be \"allow\" or \"deny\" followed by an IP address, CIDR or \"all\"", entry)
+	}
+
+	rule := &AccessRule{Allow: fields[0] == "allow"}
+	if fields[1] != "all" {
+		network, err := parseNetwork(fields[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid access rule \"%s\": %s", entry, err)
+		}
+		rule.Network = network
+	}
+	return rule, nil
+}
+
+func (r *AccessRule) String() string {
+	action := "deny"
+	if r.Allow {
+		action = "allow"
+	}
+	if r.Network == nil {
+		return action + " all"
+	}
+	return action + " " + r.Network.String()
+}
+
+// accessAllowed returns whether the client address is allowed by the rules, the first matching rule applying.
+// When no rule matches, the client is denied if there are allow rules (allowlist), and allowed otherwise (denylist).
+func accessAllowed(rules []*AccessRule, client net.Addr) bool {
+	var ip net.IP
+	switch addr := client.(type) {
+	case *net.TCPAddr:
+		ip = addr.IP
+	case *net.UDPAddr:
+		ip = addr.IP
+	}
+
+	hasAllowRules := false
+	for _, rule := range rules {
+		if rule.Network == nil || (ip != nil && rule.Network.Contains(ip)) {
+			return rule.Allow
+		}
+		hasAllowRules = hasAllowRules || rule.Allow
+	}
+	return !hasAllowRules
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseAccessRules(t *testing.T) {
+	rules, err := parseAccessRules("allow 10.0.0.0/8, deny 10.1.2.3 ,allow 2001:db8::/32,DENY all")
+	assert.Nil(t, err)
+	var rulesStrs []string
+	for _, rule := range rules {
+		rulesStrs = append(rulesStrs, rule.String())
+	}
+	assert.Equal(t, []string{"allow 10.0.0.0/8", "deny 10.1.2.3/32", "allow 2001:db8::/32", "deny all"}, rulesStrs)
+
+	rules, err = parseAccessRules("")
+	assert.Nil(t, err)
+	assert.Empty(t, rules)
+
+	_, err = parseAccessRules("allow 10.0.0.0/8, permit all")
+	assert.EqualError(t, err, "invalid access rule \"permit all\", must be \"allow\" or \"deny\" followed by an IP address, CIDR or \"all\"")
+	_, err = parseAccessRules("deny 10.0.0.0/8 10.1.0.0/16")
+	assert.EqualError(t, err, "invalid access rule \"deny 10.0.0.0/8 10.1.0.0/16\", must be \"allow\" or \"deny\" followed by an IP address, CIDR or \"all\"")
+	_, err = parseAccessRules("deny example.com")
+	assert.EqualError(t, err, "invalid access rule \"deny example.com\": invalid IP address or CIDR \"example.com\"")
+}
+
+func TestAccessAllowed(t *testing.T) {
+	mustParse := func(value string) []*AccessRule {
+		rules, err := parseAccessRules(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return rules
+	}
+	tcpAddr := func(ip string) net.Addr {
+		return &net.TCPAddr{IP: net.ParseIP(ip), Port: 12345}
+	}
+
+	for _, test := range []struct {
+		rules    string
+		client   net.Addr
+		expected bool
+	}{
+		{"", tcpAddr("192.168.1.10"), true},
+		// Allowlists deny the clients not matching
+		{"allow 10.0.0.0/8", tcpAddr("10.1.2.3"), true},
+		{"allow 10.0.0.0/8", tcpAddr("192.168.1.10"), false},
+		// Denylists allow the clients not matching
+		{"deny 10.0.0.0/8", tcpAddr("10.1.2.3"), false},
+		{"deny 10.0.0.0/8", tcpAddr("192.168.1.10"), true},
+		// The first matching rule applies
+		{"deny 10.1.0.0/16, allow 10.0.0.0/8", tcpAddr("10.1.2.3"), false},
+		{"deny 10.1.0.0/16, allow 10.0.0.0/8", tcpAddr("10.2.0.1"), true},
+		{"allow 10.0.0.0/8, deny 10.1.0.0/16", tcpAddr("10.1.2.3"), true},
+		{"deny 10.0.0.0/8, allow all", tcpAddr("192.168.1.10"), true},
+		{"allow 10.0.0.0/8, deny all", tcpAddr("192.168.1.10"), false},
+		// IPv6, and IPv4 clients on dual-stack sockets
+		{"allow 2001:db8::/32", tcpAddr("2001:db8::1"), true},
+		{"allow 2001:db8::/32", tcpAddr("2001:db9::1"), false},
+		{"allow 10.0.0.0/8", tcpAddr("::ffff:10.1.2.3"), true},
+		{"deny 127.0.0.1", &net.UDPAddr{IP: net.ParseIP("127.0.0.1"), Port: 53}, false},
+	} {
+		assert.Equal(t, test.expected, accessAllowed(mustParse(test.rules), test.client), "%s: %s", test.rules, test.client)
+	}
+}
+
+func TestTcpRelayAccess(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	allowedPort := getFreePort(t)
+	deniedPort := getFreePort(t)
+	relay := func(localPort int64, rules string) *tcpRelay {
+		access, err := parseAccessRules(rules)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &tcpRelay{
+			port: &PortForward{
+				LocalPort:  localPort,
+				RemoteHost: "127.0.0.1",
+				RemotePort: remotePort,
+			},
+			dialer:  newDialer(nil),
+			access:  access,
+			metrics: &forwardMetrics{}, // read by the test while serving
+		}
+	}
+	startRelay(t, relay(allowedPort, "allow 127.0.0.0/8"))
+	deniedRelay := relay(deniedPort, "deny 127.0.0.1")
+	startRelay(t, deniedRelay)
+
+	assertEcho(t, allowedPort, "allowed")
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", deniedPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprintf(conn, "denied\n")
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&deniedRelay.metrics.deniedConnections))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&deniedRelay.metrics.dialErrors))
+	assert.Equal(t, int64(0), deniedRelay.metrics.dialDuration.count)
+}
+
+func TestUdpRelayAccess(t *testing.T) {
+	access, err := parseAccessRules("deny all")
+	if err != nil {
+		t.Fatal(err)
+	}
+	localPort := getFreePort(t)
+	relay := &udpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: 9,
+			Protocol:   ProtocolUDP,
+		},
+		access:      access,
+		idleTimeout: time.Second,
+		metrics:     &forwardMetrics{}, // read by the test while serving
+	}
+	startRelay(t, relay)
+
+	conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	for i := 0; i < 3; i++ {
+		_, _ = fmt.Fprintf(conn, "denied %d\n", i)
+	}
+	time.Sleep(RelayTestThinktime)
+
+	// Every datagram is counted, but logged once per client IP
+	assert.Equal(t, int64(3), atomic.LoadInt64(&relay.metrics.deniedConnections))
+	assert.Equal(t, int64(0), relay.metrics.dialDuration.count)
+	relay.lock.Lock()
+	assert.Empty(t, relay.sessions)
+	relay.lock.Unlock()
+
+	logRelay := &udpRelay{port: relay.port, deniedLogged: make(map[string]time.Time)}
+	assert.True(t, logRelay.logDenied(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}))
+	assert.False(t, logRelay.logDenied(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1001}))
+	assert.True(t, logRelay.logDenied(&net.UDPAddr{IP: net.ParseIP("10.0.0.2"), Port: 1000}))
+
+	logRelay.deniedLogged["10.0.0.1"] = time.Now().Add(-UdpDeniedLogInterval)
+	assert.True(t, logRelay.logDenied(&net.UDPAddr{IP: net.ParseIP("10.0.0.1"), Port: 1000}))
+}
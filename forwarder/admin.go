@@ -0,0 +1,174 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const HttpShutdownTimeout = 5 * time.Second
+
+// adminServer is an HTTP API for managing the port forwards at runtime:
+//
+//	GET    /forwards               list the port forwards and their status
+//	POST   /forwards               add a port mapping, body: {"key": "PORT_A", "mapping": "8080:nginx:80"}
+//	DELETE /forwards?id=ID         remove a port forward
+//	POST   /forwards/restart?id=ID restart a port forward
+//	GET    /metrics                metrics in Prometheus format
+//
+// If a token is given, requests must be authenticated with it ("Authorization: Bearer TOKEN").
+type adminServer struct {
+	manager *Manager
+	token   string
+}
+
+// AddForwardRequest is the body of the request for adding a port mapping, with the same syntax as the PORT env vars
+type AddForwardRequest struct {
+	Key     string `json:"key"`
+	Mapping string `json:"mapping"`
+}
+
+// AdminError is the body of the admin API error responses
+type AdminError struct {
+	Errors []string `json:"errors"`
+}
+
+func (a *adminServer) handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/forwards", a.handleForwards)
+	mux.HandleFunc("/forwards/restart", a.handleRestart)
+	mux.Handle("/metrics", forwardsMetrics)
+	if a.token == "" {
+		return mux
+	}
+	return a.authenticated(mux)
+}
+
+// authenticated requires the requests to the handler to have the bearer token of the server
+func (a *adminServer) authenticated(handler http.Handler) http.Handler {
+	expected := []byte("Bearer " + a.token)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeErrors(w, http.StatusUnauthorized, fmt.Errorf("unauthorized"))
+			return
+		}
+		handler.ServeHTTP(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
+
+func writeErrors(w http.ResponseWriter, status int, errors ...error) {
+	body := AdminError{}
+	for _, err := range errors {
+		body.Errors = append(body.Errors, err.Error())
+	}
+	writeJSON(w, status, body)
+}
+
+func (a *adminServer) handleForwards(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		writeJSON(w, http.StatusOK, a.manager.List())
+	case http.MethodPost:
+		a.handleAdd(w, r)
+	case http.MethodDelete:
+		err := a.manager.Remove(r.URL.Query().Get("id"))
+		if err != nil {
+			writeErrors(w, http.StatusNotFound, err)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		writeErrors(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+	}
+}
+
+func (a *adminServer) handleAdd(w http.ResponseWriter, r *http.Request) {
+	var request AddForwardRequest
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeErrors(w, http.StatusBadRequest, fmt.Errorf("invalid request body: %s", err))
+		return
+	}
+	if request.Key == "" {
+		request.Key = "admin"
+	}
+
+	ports, err := parseEnvPort(request.Mapping)
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, fmt.Errorf("invalid port mapping \"%s=%s\": %s", request.Key, request.Mapping, err))
+		return
+	}
+	for _, port := range ports {
+		port.Key = request.Key
+	}
+
+	if errors := a.manager.Add(ports); len(errors) == 1 && errors[0] == ErrManagerNotRunning {
+		writeErrors(w, http.StatusServiceUnavailable, errors...)
+		return
+	} else if errors != nil {
+		// Conflicting only with the current mappings, or invalid on its own
+		status := http.StatusConflict
+		for _, err := range errors {
+			if _, conflict := err.(*errLocalPortConflict); !conflict {
+				status = http.StatusBadRequest
+			}
+		}
+		writeErrors(w, status, errors...)
+		return
+	}
+
+	fmt.Printf("Added port mapping %s=%s from admin API\n", request.Key, request.Mapping)
+	writeJSON(w, http.StatusCreated, a.manager.List())
+}
+
+func (a *adminServer) handleRestart(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeErrors(w, http.StatusMethodNotAllowed, fmt.Errorf("method not allowed"))
+		return
+	}
+
+	if err := a.manager.Restart(r.URL.Query().Get("id")); err != nil {
+		writeErrors(w, http.StatusNotFound, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startAdminServer serves the admin API on the given address in background, until the context is cancelled,
+// requiring the given token (unless empty)
+func startAdminServer(ctx context.Context, address string, token string, manager *Manager) {
+	admin := &adminServer{manager: manager, token: token}
+	startHttpServer(ctx, "admin API", address, admin.handler())
+}
+
+// startHttpServer serves the handler on the given address in background, until the context is cancelled
+func startHttpServer(ctx context.Context, name string, address string, handler http.Handler) {
+	server := &http.Server{
+		Addr:    address,
+		Handler: handler,
+	}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), HttpShutdownTimeout)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	go func() {
+		fmt.Printf("Serving %s on %s ...\n", name, address)
+		err := server.ListenAndServe()
+		if err != nil && err != http.ErrServerClosed {
+			fmt.Printf("Serving %s failed: %s\n", name, err)
+		}
+	}()
+}
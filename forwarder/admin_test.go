@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func admintestRequest(t *testing.T, server *httptest.Server, method string, path string, body string) (int, string) {
+	request, err := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer response.Body.Close()
+
+	responseBody, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return response.StatusCode, string(responseBody)
+}
+
+func TestAdminServer(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	port := &PortForward{Key: "PORT_A", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+
+	manager := NewManager(managertestSettings(port))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = manager.Run(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	server := httptest.NewServer((&adminServer{manager: manager}).handler())
+	defer server.Close()
+
+	// Add
+	addedLocalPort := getFreePort(t)
+	status, body := admintestRequest(t, server, http.MethodPost, "/forwards", fmt.Sprintf(`{"key": "added", "mapping": "%d:127.0.0.1:%d"}`, addedLocalPort, remotePort))
+	assert.Equal(t, http.StatusCreated, status, body)
+	time.Sleep(RelayTestThinktime)
+	assertEcho(t, addedLocalPort, "added at runtime")
+
+	status, body = admintestRequest(t, server, http.MethodPost, "/forwards", `{"mapping": "8080:nginx:foo"}`)
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.JSONEq(t, `{"errors": ["invalid port mapping \"admin=8080:nginx:foo\": invalid REMOTE port: strconv.ParseInt: parsing \"foo\": invalid syntax"]}`, body)
+
+	status, body = admintestRequest(t, server, http.MethodPost, "/forwards", fmt.Sprintf(`{"mapping": "%d:nginx:80"}`, port.LocalPort))
+	assert.Equal(t, http.StatusConflict, status)
+	assert.Contains(t, body, "use the same local port")
+
+	status, body = admintestRequest(t, server, http.MethodPost, "/forwards", fmt.Sprintf(`{"mapping": "%d:nginx:80@undefined"}`, getFreePort(t)))
+	assert.Equal(t, http.StatusBadRequest, status)
+	assert.Contains(t, body, "undefined")
+
+	// List
+	status, body = admintestRequest(t, server, http.MethodGet, "/forwards", "")
+	assert.Equal(t, http.StatusOK, status)
+	var statuses []ForwardStatus
+	assert.Nil(t, json.Unmarshal([]byte(body), &statuses))
+	assert.Len(t, statuses, 2)
+	for _, forwardStatus := range statuses {
+		assert.Equal(t, StateRunning, forwardStatus.State)
+		assert.Contains(t, []string{"PORT_A", "added"}, forwardStatus.Key)
+	}
+
+	// Restart & remove
+	status, _ = admintestRequest(t, server, http.MethodPost, "/forwards/restart?id="+url.QueryEscape(port.ListenerId()), "")
+	assert.Equal(t, http.StatusNoContent, status)
+	time.Sleep(RelayTestThinktime)
+	assertEcho(t, port.LocalPort, "restarted")
+
+	status, _ = admintestRequest(t, server, http.MethodDelete, "/forwards?id="+url.QueryEscape(port.ListenerId()), "")
+	assert.Equal(t, http.StatusNoContent, status)
+	status, _ = admintestRequest(t, server, http.MethodDelete, "/forwards?id="+url.QueryEscape(port.ListenerId()), "")
+	assert.Equal(t, http.StatusNotFound, status)
+	assert.Len(t, manager.List(), 1)
+
+	// Adding to a stopped manager fails
+	cancel()
+	time.Sleep(RelayTestThinktime)
+	status, body = admintestRequest(t, server, http.MethodPost, "/forwards", fmt.Sprintf(`{"mapping": "%d:127.0.0.1:%d"}`, getFreePort(t), remotePort))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+	assert.JSONEq(t, `{"errors": ["port forwards manager not running"]}`, body)
+}
+
+func TestAdminServerToken(t *testing.T) {
+	manager := NewManager(managertestSettings())
+	server := httptest.NewServer((&adminServer{manager: manager, token: "secret"}).handler())
+	defer server.Close()
+
+	status, body := admintestRequest(t, server, http.MethodGet, "/forwards", "")
+	assert.Equal(t, http.StatusUnauthorized, status)
+	assert.JSONEq(t, `{"errors": ["unauthorized"]}`, body)
+
+	for authorization, expectedStatus := range map[string]int{
+		"Bearer secret": http.StatusOK,
+		"Bearer other":  http.StatusUnauthorized,
+		"secret":        http.StatusUnauthorized,
+	} {
+		request, err := http.NewRequest(http.MethodGet, server.URL+"/forwards", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		request.Header.Set("Authorization", authorization)
+		response, err := http.DefaultClient.Do(request)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = response.Body.Close()
+		assert.Equal(t, expectedStatus, response.StatusCode, authorization)
+	}
+}
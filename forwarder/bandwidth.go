@@ -0,0 +1,236 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// RateLimit is a token bucket limit, in bytes per second, allowing bursts of up to Burst bytes
+type RateLimit struct {
+	Rate  int64 // 0 for unlimited
+	Burst int64 // the rate (one second worth of data) by default
+}
+
+func (l RateLimit) burst() int64 {
+	if l.Burst > 0 {
+		return l.Burst
+	}
+	return l.Rate
+}
+
+// BandwidthLimits are the rate limits of a mapping, on each direction ("upload" being from the clients to the remote),
+// for the aggregate of all the connections and for each connection
+type BandwidthLimits struct {
+	MappingUpload      RateLimit
+	MappingDownload    RateLimit
+	ConnectionUpload   RateLimit
+	ConnectionDownload RateLimit
+}
+
+// parseByteSize parses a number of bytes, optionally with a K, M or G suffix (powers of 1024, like "512K" or "10MB")
+func parseByteSize(value string) (int64, error) {
+	number := strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	multiplier := int64(1)
+	for i, suffix := range []string{"K", "M", "G"} {
+		if strings.HasSuffix(number, suffix) {
+			number = strings.TrimSuffix(number, suffix)
+			multiplier = int64(1) << (10 * (i + 1))
+			break
+		}
+	}
+
+	size, err := strconv.ParseInt(number, 10, 64)
+	if err != nil || size <= 0 {
+		return 0, fmt.Errorf("invalid size \"%s\", must be a positive number of bytes, optionally with a K, M or G suffix", value)
+	}
+	return size * multiplier, nil
+}
+
+// tokenBucket throttles the data sent through it to the rate of its limit, allowing bursts.
+// The limit can be changed at any time.
+type tokenBucket struct {
+	lock   sync.Mutex
+	limit  RateLimit
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(limit RateLimit) *tokenBucket {
+	bucket := &tokenBucket{}
+	bucket.setLimit(limit)
+	return bucket
+}
+
+func (b *tokenBucket) setLimit(limit RateLimit) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	now := time.Now()
+	if b.limit.Rate == 0 {
+		// Starting to limit: the bucket starts full
+		b.tokens = float64(limit.burst())
+	} else {
+		b.refill(now)
+	}
+	b.last = now
+	b.limit = limit
+	if burst := float64(limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+}
+
+// refill adds the tokens for the time elapsed since the last refill. Must be called with the bucket locked.
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.limit.Rate)
+	if burst := float64(b.limit.burst()); b.tokens > burst {
+		b.tokens = burst
+	}
+	b.last = now
+}
+
+// chunkSize returns the maximum bytes, of the given ones, that can be sent at once (the burst size)
+func (b *tokenBucket) chunkSize(n int) int {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if burst := b.limit.burst(); b.limit.Rate > 0 && int64(n) > burst {
+		return int(burst)
+	}
+	return n
+}
+
+// reserve takes the tokens for sending the given bytes, returning the time to wait before sending them
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if b.limit.Rate == 0 {
+		return 0
+	}
+	b.refill(time.Now())
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / float64(b.limit.Rate) * float64(time.Second))
+}
+
+// throttledWriter writes to the writer at the rate allowed by all the buckets
+type throttledWriter struct {
+	writer  io.Writer
+	buckets []*tokenBucket
+	done    <-chan struct{} // closed for interrupting the wait for the limits
+}
+
+func (w *throttledWriter) Write(p []byte) (written int, err error) {
+	for len(p) > 0 {
+		n := len(p)
+		for _, bucket := range w.buckets {
+			n = bucket.chunkSize(n)
+		}
+
+		var delay time.Duration
+		for _, bucket := range w.buckets {
+			if d := bucket.reserve(n); d > delay {
+				delay = d
+			}
+		}
+		if delay > 0 {
+			timer := time.NewTimer(delay)
+			select {
+			case <-timer.C:
+			case <-w.done:
+				timer.Stop()
+				return written, io.ErrClosedPipe
+			}
+		}
+
+		n, err = w.writer.Write(p[:n])
+		written += n
+		if err != nil {
+			return
+		}
+		p = p[n:]
+	}
+	return
+}
+
+// bandwidthLimiter applies the bandwidth limits of a mapping to its connections,
+// updating them (including the active connections) when changed
+type bandwidthLimiter struct {
+	lock        sync.Mutex
+	limits      BandwidthLimits
+	upload      *tokenBucket // aggregate of all the connections
+	download    *tokenBucket
+	connections map[*connBandwidth]struct{}
+}
+
+// connBandwidth are the buckets of a single connection; closing it interrupts its throttled writes
+type connBandwidth struct {
+	limiter   *bandwidthLimiter
+	upload    *tokenBucket
+	download  *tokenBucket
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// Close removes the connection from the limiter, making its pending and next writes fail
+func (c *connBandwidth) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.done)
+		c.limiter.lock.Lock()
+		defer c.limiter.lock.Unlock()
+		delete(c.limiter.connections, c)
+	})
+	return nil
+}
+
+func newBandwidthLimiter(limits *BandwidthLimits) *bandwidthLimiter {
+	l := &bandwidthLimiter{connections: make(map[*connBandwidth]struct{})}
+	if limits != nil {
+		l.limits = *limits
+	}
+	l.upload = newTokenBucket(l.limits.MappingUpload)
+	l.download = newTokenBucket(l.limits.MappingDownload)
+	return l
+}
+
+// update applies the new limits, or removes them if nil
+func (l *bandwidthLimiter) update(limits *BandwidthLimits) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.limits = BandwidthLimits{}
+	if limits != nil {
+		l.limits = *limits
+	}
+	l.upload.setLimit(l.limits.MappingUpload)
+	l.download.setLimit(l.limits.MappingDownload)
+	for conn := range l.connections {
+		conn.upload.setLimit(l.limits.ConnectionUpload)
+		conn.download.setLimit(l.limits.ConnectionDownload)
+	}
+}
+
+// connection returns the writers throttling the upload (to the remote) and download (to the client) of a new connection,
+// and the closer to call when it finishes, or for interrupting the writes waiting for the limits
+func (l *bandwidthLimiter) connection(client io.Writer, remote io.Writer) (uploadWriter io.Writer, downloadWriter io.Writer, closer io.Closer) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	conn := &connBandwidth{
+		limiter:  l,
+		upload:   newTokenBucket(l.limits.ConnectionUpload),
+		download: newTokenBucket(l.limits.ConnectionDownload),
+		done:     make(chan struct{}),
+	}
+	l.connections[conn] = struct{}{}
+
+	uploadWriter = &throttledWriter{writer: remote, buckets: []*tokenBucket{conn.upload, l.upload}, done: conn.done}
+	downloadWriter = &throttledWriter{writer: client, buckets: []*tokenBucket{conn.download, l.download}, done: conn.done}
+	return uploadWriter, downloadWriter, conn
+}
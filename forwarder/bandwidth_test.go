@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseByteSize(t *testing.T) {
+	for value, expected := range map[string]int64{
+		"1000":  1000,
+		"512K":  512 * 1024,
+		"512kb": 512 * 1024,
+		"10M":   10 * 1024 * 1024,
+		"10MiB": 10 * 1024 * 1024,
+		"1G":    1024 * 1024 * 1024,
+	} {
+		size, err := parseByteSize(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+
+	for _, value := range []string{"", "0", "-1K", "10T", "1.5M", "M"} {
+		_, err := parseByteSize(value)
+		assert.EqualError(t, err, fmt.Sprintf("invalid size \"%s\", must be a positive number of bytes, optionally with a K, M or G suffix", value))
+	}
+}
+
+func TestTokenBucket(t *testing.T) {
+	bucket := newTokenBucket(RateLimit{})
+	assert.Equal(t, 100000, bucket.chunkSize(100000))
+	assert.Equal(t, time.Duration(0), bucket.reserve(100000))
+
+	// Starts full, allowing a burst
+	bucket.setLimit(RateLimit{Rate: 1000, Burst: 2000})
+	assert.Equal(t, 2000, bucket.chunkSize(100000))
+	assert.Equal(t, time.Duration(0), bucket.reserve(2000))
+	assert.InDelta(t, float64(500*time.Millisecond), float64(bucket.reserve(500)), float64(10*time.Millisecond))
+
+	// Lowering the burst keeps the debt
+	bucket.setLimit(RateLimit{Rate: 1000, Burst: 100})
+	assert.InDelta(t, float64(600*time.Millisecond), float64(bucket.reserve(100)), float64(10*time.Millisecond))
+
+	bucket.setLimit(RateLimit{})
+	assert.Equal(t, time.Duration(0), bucket.reserve(100000))
+}
+
+func TestTcpRelayBandwidth(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+	relay := &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(nil),
+		bandwidth: newBandwidthLimiter(&BandwidthLimits{
+			MappingUpload:      RateLimit{Rate: 40000},
+			ConnectionDownload: RateLimit{Rate: 20000, Burst: 4000},
+		}),
+	}
+	startRelay(t, relay)
+
+	// Time taken for sending the data and receiving it back
+	transfer := func(conn net.Conn, size int) time.Duration {
+		data := bytes.Repeat([]byte("x"), size)
+		start := time.Now()
+		go func() { _, _ = conn.Write(data) }()
+		_ = conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		received := make([]byte, size)
+		_, err := io.ReadFull(conn, received)
+		assert.Nil(t, err)
+		return time.Since(start)
+	}
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	// Downloading is the bottleneck: 4000 bytes of burst, then 20000 bytes per second
+	elapsed := transfer(conn, 12000)
+	assert.GreaterOrEqual(t, int64(elapsed), int64(350*time.Millisecond))
+	assert.Less(t, int64(elapsed), int64(time.Second))
+
+	// The limits are removed for the active connection
+	relay.updateBandwidth(nil)
+	elapsed = transfer(conn, 12000)
+	assert.Less(t, int64(elapsed), int64(200*time.Millisecond))
+}
+
+func TestTcpRelayBandwidthDrain(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+	relay := &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+		},
+		dialer:       newDialer(nil),
+		drainTimeout: 2 * RelayTestThinktime,
+		bandwidth:    newBandwidthLimiter(&BandwidthLimits{MappingDownload: RateLimit{Rate: 1000}}),
+		metrics:      &forwardMetrics{},
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- relay.Serve(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	// The connections wait for seconds to be able to receive their data back
+	for i := 0; i < 5; i++ {
+		conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		_, _ = conn.Write(bytes.Repeat([]byte("x"), 2000))
+	}
+	time.Sleep(RelayTestThinktime)
+
+	// Closing them after the drain timeout interrupts the waits
+	cancel()
+	select {
+	case err := <-result:
+		assert.Equal(t, ErrDrainTimeout, err)
+	case <-time.After(time.Second):
+		t.Fatal("relay did not stop after the drain timeout")
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ConfigFile is the YAML (or JSON) file settings, as alternative to the environment variables.
+// Environment variables take precedence over the settings on the file.
+type ConfigFile struct {
+	Engine         string                 `yaml:"engine"`
+	SocksProxy     ConfigProxy            `yaml:"socks_proxy"`
+	Proxies        map[string]ConfigProxy `yaml:"proxies"`
+	UseProxyEnv    string                 `yaml:"use_proxy_env"`
+	Access         []string               `yaml:"access"`
+	UdpIdleTimeout string                 `yaml:"udp_idle_timeout"`
+	DrainTimeout   string                 `yaml:"drain_timeout"`
+	AdminAddress   string                 `yaml:"admin_address"`
+	AdminToken     string                 `yaml:"admin_token"`
+	MetricsAddress string                 `yaml:"metrics_address"`
+	Restart        ConfigRestart          `yaml:"restart"`
+	Ports          map[string]*ConfigPort `yaml:"ports"`
+}
+
+type ConfigRestart struct {
+	Max        string `yaml:"max"`
+	Backoff    string `yaml:"backoff"`
+	BackoffMax string `yaml:"backoff_max"`
+	ExitPolicy string `yaml:"exit_policy"`
+}
+
+// ConfigProxy is a proxy defined on the config file, with the same syntax as the SOCKS_PROXY env var
+type ConfigProxy string
+
+// UnmarshalYAML allows defining a proxy chain as a list of proxies, besides a string with the proxies separated by commas
+func (p *ConfigProxy) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind != yaml.SequenceNode {
+		return node.Decode((*string)(p))
+	}
+
+	var hops []string
+	if err := node.Decode(&hops); err != nil {
+		return err
+	}
+	*p = ConfigProxy(strings.Join(hops, ","))
+	return nil
+}
+
+// ConfigPort is a port mapping defined on the config file, either with the same syntax as the PORT env vars,
+// or with separate fields for the listener and target
+type ConfigPort struct {
+	Mapping  string `yaml:"mapping"`
+	Listen   string `yaml:"listen"`
+	Target   string `yaml:"target"`
+	Protocol string `yaml:"protocol"`
+	Proxy    string `yaml:"proxy"`
+
+	ListenTLS *ConfigListenTLS `yaml:"listen_tls"`
+	TargetTLS *ConfigTargetTLS `yaml:"target_tls"`
+
+	ProxyProtocol       string                     `yaml:"proxy_protocol"`
+	AcceptProxyProtocol *ConfigAcceptProxyProtocol `yaml:"accept_proxy_protocol"`
+	Access              []string                   `yaml:"access"`
+	Limits              *ConfigLimits              `yaml:"limits"`
+	Bandwidth           *ConfigBandwidth           `yaml:"bandwidth"`
+}
+
+// ConfigTargetTLS are the TLS settings for connecting to the remote of a mapping
+type ConfigTargetTLS struct {
+	ServerName         string `yaml:"server_name"`
+	CA                 string `yaml:"ca"`
+	Cert               string `yaml:"cert"`
+	Key                string `yaml:"key"`
+	InsecureSkipVerify bool   `yaml:"insecure_skip_verify"`
+}
+
+func (c *ConfigTargetTLS) toTargetTLS() (*TargetTLS, error) {
+	if (c.Cert == "") != (c.Key == "") {
+		return nil, fmt.Errorf("target_tls must have both cert and key, or none of them")
+	}
+	if c.InsecureSkipVerify && c.CA != "" {
+		return nil, fmt.Errorf("target_tls can not have a ca when insecure_skip_verify")
+	}
+	return &TargetTLS{
+		ServerName:         c.ServerName,
+		CAFile:             c.CA,
+		CertFile:           c.Cert,
+		KeyFile:            c.Key,
+		InsecureSkipVerify: c.InsecureSkipVerify,
+	}, nil
+}
+
+// ConfigListenTLS are the TLS settings of the local port of a mapping
+type ConfigListenTLS struct {
+	Cert       string `yaml:"cert"`
+	Key        string `yaml:"key"`
+	SelfSigned bool   `yaml:"self_signed"`
+
+	ClientCA     string   `yaml:"client_ca"`
+	AllowedNames []string `yaml:"allowed_names"`
+}
+
+func (c *ConfigListenTLS) toListenTLS() (*ListenTLS, error) {
+	if c.SelfSigned && (c.Cert != "" || c.Key != "") {
+		return nil, fmt.Errorf("listen_tls can not have a cert or key when self_signed")
+	}
+	if !c.SelfSigned && (c.Cert == "" || c.Key == "") {
+		return nil, fmt.Errorf("listen_tls must have a cert and key, or be self_signed")
+	}
+	if len(c.AllowedNames) > 0 && c.ClientCA == "" {
+		return nil, fmt.Errorf("listen_tls can not have allowed_names without client_ca")
+	}
+	return &ListenTLS{
+		CertFile:     c.Cert,
+		KeyFile:      c.Key,
+		ClientCAFile: c.ClientCA,
+		AllowedNames: c.AllowedNames,
+	}, nil
+}
+
+type ConfigAcceptProxyProtocol struct {
+	Trusted []string `yaml:"trusted"`
+}
+
+func (c *ConfigAcceptProxyProtocol) toAcceptProxyProtocol() (*AcceptProxyProtocol, error) {
+	if len(c.Trusted) == 0 {
+		return nil, fmt.Errorf("accept_proxy_protocol must have trusted networks (0.0.0.0/0 and ::/0 for trusting any source)")
+	}
+	settings := &AcceptProxyProtocol{}
+	for _, value := range c.Trusted {
+		network, err := parseNetwork(value)
+		if err != nil {
+			return nil, fmt.Errorf("accept_proxy_protocol has %s", err)
+		}
+		settings.TrustedNetworks = append(settings.TrustedNetworks, network)
+	}
+	return settings, nil
+}
+
+type ConfigLimits struct {
+	MaxConnections          int    `yaml:"max_connections"`
+	MaxConnectionsPerClient int    `yaml:"max_connections_per_client"`
+	OnLimit                 string `yaml:"on_limit"`
+	QueueTimeout            string `yaml:"queue_timeout"`
+}
+
+func (c *ConfigLimits) toConnectionLimits() (*ConnectionLimits, error) {
+	if c.MaxConnections < 0 || c.MaxConnectionsPerClient < 0 {
+		return nil, fmt.Errorf("limits can not be negative")
+	}
+	if c.MaxConnections == 0 && c.MaxConnectionsPerClient == 0 {
+		return nil, fmt.Errorf("limits must have max_connections or max_connections_per_client")
+	}
+
+	limits := &ConnectionLimits{
+		MaxConnections:          c.MaxConnections,
+		MaxConnectionsPerClient: c.MaxConnectionsPerClient,
+	}
+	switch strings.ToLower(c.OnLimit) {
+	case "", "reject":
+	case "queue":
+		limits.Queue = true
+	default:
+		return nil, fmt.Errorf("invalid limits on_limit \"%s\", must be reject or queue", c.OnLimit)
+	}
+
+	if c.QueueTimeout != "" && !limits.Queue {
+		return nil, fmt.Errorf("limits can not have queue_timeout without on_limit: queue")
+	}
+	if limits.Queue {
+		limits.QueueTimeout = DefaultQueueTimeout
+	}
+	if c.QueueTimeout != "" {
+		var err error
+		limits.QueueTimeoutSet = true
+		limits.QueueTimeout, err = time.ParseDuration(c.QueueTimeout)
+		if err == nil && limits.QueueTimeout <= 0 {
+			err = fmt.Errorf("must be greater than zero")
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid limits queue_timeout: %s", err)
+		}
+	}
+	return limits, nil
+}
+
+type ConfigBandwidth struct {
+	Mapping    ConfigBandwidthLimit `yaml:"mapping"`
+	Connection ConfigBandwidthLimit `yaml:"connection"`
+}
+
+// ConfigBandwidthLimit are the rate limits on each direction, as sizes in bytes per second ("10M")
+type ConfigBandwidthLimit struct {
+	Upload        string `yaml:"upload"`
+	Download      string `yaml:"download"`
+	UploadBurst   string `yaml:"upload_burst"`
+	DownloadBurst string `yaml:"download_burst"`
+}
+
+func (c *ConfigBandwidthLimit) toRateLimits(description string) (upload RateLimit, download RateLimit, err error) {
+	parse := func(rate string, burst string, name string) (limit RateLimit, err error) {
+		if rate == "" {
+			if burst != "" {
+				err = fmt.Errorf("bandwidth %s can not have %s_burst without %s", description, name, name)
+			}
+			return
+		}
+		if limit.Rate, err = parseByteSize(rate); err != nil {
+			return limit, fmt.Errorf("invalid bandwidth %s %s: %s", description, name, err)
+		}
+		if burst != "" {
+			if limit.Burst, err = parseByteSize(burst); err != nil {
+				return limit, fmt.Errorf("invalid bandwidth %s %s_burst: %s", description, name, err)
+			}
+		}
+		return
+	}
+
+	if upload, err = parse(c.Upload, c.UploadBurst, "upload"); err != nil {
+		return
+	}
+	download, err = parse(c.Download, c.DownloadBurst, "download")
+	return
+}
+
+func (c *ConfigBandwidth) toBandwidthLimits() (limits *BandwidthLimits, err error) {
+	limits = &BandwidthLimits{}
+	if limits.MappingUpload, limits.MappingDownload, err = c.Mapping.toRateLimits("mapping"); err != nil {
+		return nil, err
+	}
+	if limits.ConnectionUpload, limits.ConnectionDownload, err = c.Connection.toRateLimits("connection"); err != nil {
+		return nil, err
+	}
+	if *limits == (BandwidthLimits{}) {
+		return nil, fmt.Errorf("bandwidth must have an upload or download limit")
+	}
+	return limits, nil
+}
+
+// applyOptions sets the options of the config port mapping, not supported by the PORT env vars syntax, on the parsed ports
+func (p *ConfigPort) applyOptions(ports []*PortForward) error {
+	var listenTLS *ListenTLS
+	var targetTLS *TargetTLS
+	var err error
+	if p.ListenTLS != nil {
+		if listenTLS, err = p.ListenTLS.toListenTLS(); err != nil {
+			return err
+		}
+	}
+	if p.TargetTLS != nil {
+		if targetTLS, err = p.TargetTLS.toTargetTLS(); err != nil {
+			return err
+		}
+	}
+
+	var acceptProxyProtocol *AcceptProxyProtocol
+	if p.AcceptProxyProtocol != nil {
+		if acceptProxyProtocol, err = p.AcceptProxyProtocol.toAcceptProxyProtocol(); err != nil {
+			return err
+		}
+	}
+
+	var access []*AccessRule
+	for _, entry := range p.Access {
+		rule, err := parseAccessRule(entry)
+		if err != nil {
+			return err
+		}
+		access = append(access, rule)
+	}
+
+	var limits *ConnectionLimits
+	if p.Limits != nil {
+		if limits, err = p.Limits.toConnectionLimits(); err != nil {
+			return err
+		}
+	}
+
+	var bandwidth *BandwidthLimits
+	if p.Bandwidth != nil {
+		if bandwidth, err = p.Bandwidth.toBandwidthLimits(); err != nil {
+			return err
+		}
+	}
+
+	var proxyProtocol int
+	switch strings.ToLower(p.ProxyProtocol) {
+	case "":
+	case "v1":
+		proxyProtocol = ProxyProtocolV1
+	case "v2":
+		proxyProtocol = ProxyProtocolV2
+	default:
+		return fmt.Errorf("invalid proxy_protocol \"%s\", must be v1 or v2", p.ProxyProtocol)
+	}
+
+	for _, port := range ports {
+		port.ListenTLS = listenTLS
+		port.TargetTLS = targetTLS
+		port.ProxyProtocol = proxyProtocol
+		port.AcceptProxyProtocol = acceptProxyProtocol
+		port.Access = access
+		port.Limits = limits
+		port.Bandwidth = bandwidth
+	}
+	return nil
+}
+
+// UnmarshalYAML allows defining a port mapping as a single string ("8080:nginx:80")
+func (p *ConfigPort) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		return node.Decode(&p.Mapping)
+	}
+
+	// Decoding from a node does not check for unknown fields, even if the root decoder does
+	if err := checkKnownFields(node, reflect.TypeOf(*p)); err != nil {
+		return err
+	}
+
+	type plainConfigPort ConfigPort
+	return node.Decode((*plainConfigPort)(p))
+}
+
+// checkKnownFields returns an error if the mapping node (or any mapping nested on it)
+// has keys not matching the yaml fields of the given struct type
+func checkKnownFields(node *yaml.Node, structType reflect.Type) error {
+	if node.Kind != yaml.MappingNode {
+		return nil
+	}
+
+	fields := make(map[string]reflect.Type)
+	for i := 0; i < structType.NumField(); i++ {
+		field := structType.Field(i)
+		name := strings.Split(field.Tag.Get("yaml"), ",")[0]
+		fieldType := field.Type
+		if fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		fields[name] = fieldType
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		key, value := node.Content[i], node.Content[i+1]
+		fieldType, ok := fields[key.Value]
+		if !ok {
+			return fmt.Errorf("line %d: field %s not found in type %s", key.Line, key.Value, structType.Name())
+		}
+		if fieldType.Kind() == reflect.Struct {
+			if err := checkKnownFields(value, fieldType); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// toMapping returns the port mapping with the PORT env vars syntax
+func (p *ConfigPort) toMapping() (string, error) {
+	if p.Mapping != "" {
+		if p.Listen != "" || p.Target != "" || p.Protocol != "" {
+			return "", fmt.Errorf("mapping can not be combined with listen, target or protocol")
+		}
+		return p.withProxy(p.Mapping), nil
+	}
+
+	if p.Target == "" {
+		return "", fmt.Errorf("should at least contain a target (REMOTE_HOST:REMOTE_PORT)")
+	}
+
+	mapping := p.Target
+	if p.Listen != "" {
+		mapping = p.Listen + ":" + mapping
+	}
+	if p.Protocol != "" {
+		mapping += "/" + p.Protocol
+	}
+	return p.withProxy(mapping), nil
+}
+
+// withProxy appends the proxy of the port mapping, if any, to the given mapping
+func (p *ConfigPort) withProxy(mapping string) string {
+	if p.Proxy == "" {
+		return mapping
+	}
+	return mapping + "@" + p.Proxy
+}
+
+func loadConfigFile(path string) (config *ConfigFile, err error) {
+	file, err := os.Open(path)
+	if err != nil {
+		err = fmt.Errorf("could not read config file: %s", err)
+		return
+	}
+	defer file.Close()
+
+	config = &ConfigFile{}
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err = decoder.Decode(config); err != nil {
+		err = fmt.Errorf("invalid config file %s: %s", path, err)
+		config = nil
+	}
+	return
+}
+
+// mergeEnvironment returns the given env vars, along with the settings from the config file
+// (using the env vars keys) that are not defined as env vars
+func (c *ConfigFile) mergeEnvironment(allEnv map[string]string) map[string]string {
+	configEnv := map[string]string{
+		EnvEngine:            c.Engine,
+		EnvSocksProxy:        string(c.SocksProxy),
+		EnvUseProxyEnv:       c.UseProxyEnv,
+		EnvAccessRules:       strings.Join(c.Access, ","),
+		EnvUdpIdleTimeout:    c.UdpIdleTimeout,
+		EnvDrainTimeout:      c.DrainTimeout,
+		EnvAdminAddress:      c.AdminAddress,
+		EnvAdminToken:        c.AdminToken,
+		EnvMetricsAddress:    c.MetricsAddress,
+		EnvRestartMax:        c.Restart.Max,
+		EnvRestartBackoff:    c.Restart.Backoff,
+		EnvRestartBackoffMax: c.Restart.BackoffMax,
+		EnvExitPolicy:        c.Restart.ExitPolicy,
+	}
+
+	for name, rawProxy := range c.Proxies {
+		configEnv[EnvProxyPrefix+strings.ToUpper(name)] = string(rawProxy)
+	}
+
+	merged := make(map[string]string)
+	for key, value := range configEnv {
+		if value != "" {
+			merged[key] = value
+		}
+	}
+	for key, value := range allEnv {
+		merged[key] = value
+	}
+	return merged
+}
+
+// loadConfigPorts parses the port mappings defined on the config file,
+// except those with the same key as a PORT env var (which take precedence)
+func loadConfigPorts(config *ConfigFile, allEnv map[string]string) (ports []*PortForward, errors []error) {
+	for key, configPort := range config.Ports {
+		if _, ok := allEnv[key]; ok {
+			continue
+		}
+
+		parsedPorts, err := func() ([]*PortForward, error) {
+			if configPort == nil {
+				return nil, fmt.Errorf("empty mapping")
+			}
+			mapping, err := configPort.toMapping()
+			if err != nil {
+				return nil, err
+			}
+			ports, err := parseEnvPort(mapping)
+			if err != nil {
+				return nil, err
+			}
+			return ports, configPort.applyOptions(ports)
+		}()
+
+		if err != nil {
+			errors = append(errors, fmt.Errorf("invalid port mapping \"%s\" on config file: %s", key, err))
+			continue
+		}
+		for _, port := range parsedPorts {
+			port.Key = key
+		}
+		ports = append(ports, parsedPorts...)
+	}
+
+	return
+}
@@ -0,0 +1,576 @@
+package main
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeConfigFile writes the given content on a temporary config file, returning its path
+func writeConfigFile(t *testing.T, name string, content string) string {
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadSettingsConfigFile(t *testing.T) {
+	t.Run("yaml", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+engine: socat
+drain_timeout: 30s
+restart:
+  max: 3
+  exit_policy: exit
+ports:
+  web: "8080:nginx:80"
+  dns:
+    listen: 5353
+    target: 10.0.0.2:53
+    protocol: udp
+  PORT_OVERRIDDEN: "9000:old:9000"
+`)
+		env := map[string]string{
+			"PORT_OVERRIDDEN": "9000:new:9000",
+			"ENGINE":          "native",
+		}
+		settingstestSetup(env)
+		defer settingstestTeardown(env)
+
+		settings, errs := LoadSettings(path)
+		assert.Empty(t, errs)
+		assert.Equal(t, EngineNative, settings.Engine)
+		assert.Equal(t, 30*time.Second, settings.DrainTimeout)
+		assert.Equal(t, 3, settings.Restart.MaxRestarts)
+		assert.Equal(t, ExitPolicyExit, settings.Restart.ExitPolicy)
+		assert.ElementsMatch(t, []*PortForward{
+			{
+				Key:        "web",
+				LocalPort:  8080,
+				RemoteHost: "nginx",
+				RemotePort: 80,
+				Protocol:   ProtocolTCP,
+			},
+			{
+				Key:        "dns",
+				LocalPort:  5353,
+				RemoteHost: "10.0.0.2",
+				RemotePort: 53,
+				Protocol:   ProtocolUDP,
+			},
+			{
+				Key:        "PORT_OVERRIDDEN",
+				LocalPort:  9000,
+				RemoteHost: "new",
+				RemotePort: 9000,
+				Protocol:   ProtocolTCP,
+			},
+		}, settings.Ports)
+	})
+
+	t.Run("json", func(t *testing.T) {
+		path := writeConfigFile(t, "config.json", `{
+			"socks_proxy": "tor:9050",
+			"ports": {"web": {"target": "nginx:80"}}
+		}`)
+		env := map[string]string{EnvConfigFile: path}
+		settingstestSetup(env)
+		defer settingstestTeardown(env)
+
+		settings, errs := LoadSettings("")
+		assert.Empty(t, errs)
+		assert.Equal(t, path, settings.ConfigFile)
+		assert.Equal(t, &Proxy{Scheme: ProxySchemeSocks4a, Host: "tor", Port: 9050}, settings.Proxy)
+		assert.Equal(t, []*PortForward{{
+			Key:        "web",
+			LocalPort:  80,
+			RemoteHost: "nginx",
+			RemotePort: 80,
+			Protocol:   ProtocolTCP,
+		}}, settings.Ports)
+	})
+
+	t.Run("proxies", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+socks_proxy: "tor:9050"
+proxies:
+  corp: "http://proxy.corp:3128"
+  chain:
+    - "socks5://bastion:1080"
+    - "http://proxy.corp:3128"
+ports:
+  web: "8080:nginx:80@direct"
+  intranet:
+    target: "wiki.corp:443"
+    proxy: corp
+`)
+		env := map[string]string{EnvConfigFile: path}
+		settingstestSetup(env)
+		defer settingstestTeardown(env)
+
+		settings, errs := LoadSettings("")
+		assert.Empty(t, errs)
+		assert.Equal(t, map[string]*Proxy{
+			"corp": {Scheme: ProxySchemeHttp, Host: "proxy.corp", Port: 3128},
+			"chain": {
+				Scheme: ProxySchemeSocks5,
+				Host:   "bastion",
+				Port:   1080,
+				Next:   &Proxy{Scheme: ProxySchemeHttp, Host: "proxy.corp", Port: 3128},
+			},
+		}, settings.Proxies)
+		for _, port := range settings.Ports {
+			switch port.Key {
+			case "web":
+				assert.Equal(t, ProxyDirect, port.ProxyName)
+				assert.Nil(t, settings.proxyFor(port))
+			case "intranet":
+				assert.Equal(t, "corp", port.ProxyName)
+				assert.Equal(t, settings.Proxies["corp"], settings.proxyFor(port))
+			}
+		}
+	})
+
+	t.Run("listen_tls", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+ports:
+  web:
+    mapping: "443:nginx:80"
+    listen_tls:
+      cert: /certs/tls.crt
+      key: /certs/tls.key
+  api:
+    target: "api:8080"
+    listen_tls:
+      self_signed: true
+  admin:
+    mapping: "9443:admin:80"
+    listen_tls:
+      self_signed: true
+      client_ca: /certs/ca.crt
+      allowed_names: [ops.example.com]
+`)
+		settings, errs := LoadSettings(path)
+		if !assert.Empty(t, errs) {
+			return
+		}
+		for _, port := range settings.Ports {
+			switch port.Key {
+			case "web":
+				assert.Equal(t, &ListenTLS{CertFile: "/certs/tls.crt", KeyFile: "/certs/tls.key"}, port.ListenTLS)
+			case "api":
+				assert.Equal(t, &ListenTLS{}, port.ListenTLS)
+			case "admin":
+				assert.Equal(t, &ListenTLS{ClientCAFile: "/certs/ca.crt", AllowedNames: []string{"ops.example.com"}}, port.ListenTLS)
+			}
+		}
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+ports:
+  a:
+    mapping: "443:nginx:80"
+    listen_tls:
+      cert: /certs/tls.crt
+  b:
+    mapping: "53:10.0.0.2:53/udp"
+    listen_tls:
+      self_signed: true
+  c:
+    mapping: "8443:admin:80"
+    listen_tls:
+      self_signed: true
+      allowed_names: [ops.example.com]
+`)
+		_, errs = LoadSettings(path)
+		var errsStrs []string
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"invalid port mapping \"a\" on config file: listen_tls must have a cert and key, or be self_signed",
+			"invalid port mapping \"c\" on config file: listen_tls can not have allowed_names without client_ca",
+		}, errsStrs)
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+ports:
+  b:
+    mapping: "53:10.0.0.2:53/udp"
+    listen_tls:
+      self_signed: true
+`)
+		_, errs = LoadSettings(path)
+		errsStrs = nil
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"UDP port mapping 53:10.0.0.2:53/udp can not use TLS",
+			"TLS listeners are not supported by the socat engine",
+		}, errsStrs)
+	})
+
+	t.Run("proxy_protocol", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+ports:
+  web:
+    mapping: "80:nginx:8080"
+    proxy_protocol: v2
+    accept_proxy_protocol:
+      trusted: [10.0.0.0/8, "2001:db8::1"]
+`)
+		settings, errs := LoadSettings(path)
+		if assert.Empty(t, errs) {
+			assert.Equal(t, ProxyProtocolV2, settings.Ports[0].ProxyProtocol)
+			assert.Equal(t, &AcceptProxyProtocol{TrustedNetworks: []*net.IPNet{
+				{IP: net.IP{10, 0, 0, 0}, Mask: net.CIDRMask(8, 32)},
+				{IP: net.ParseIP("2001:db8::1"), Mask: net.CIDRMask(128, 128)},
+			}}, settings.Ports[0].AcceptProxyProtocol)
+		}
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+ports:
+  a:
+    mapping: "80:nginx:8080"
+    proxy_protocol: v3
+  b:
+    mapping: "81:nginx:8080"
+    accept_proxy_protocol:
+      trusted: [10.0.0.0/33]
+  c:
+    mapping: "82:nginx:8080"
+    accept_proxy_protocol: {}
+`)
+		_, errs = LoadSettings(path)
+		var errsStrs []string
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"invalid port mapping \"a\" on config file: invalid proxy_protocol \"v3\", must be v1 or v2",
+			"invalid port mapping \"b\" on config file: accept_proxy_protocol has invalid IP address or CIDR \"10.0.0.0/33\"",
+			"invalid port mapping \"c\" on config file: accept_proxy_protocol must have trusted networks (0.0.0.0/0 and ::/0 for trusting any source)",
+		}, errsStrs)
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+ports:
+  b:
+    mapping: "53:10.0.0.2:53/udp"
+    proxy_protocol: v1
+    accept_proxy_protocol:
+      trusted: [0.0.0.0/0]
+`)
+		_, errs = LoadSettings(path)
+		errsStrs = nil
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"UDP port mapping 53:10.0.0.2:53/udp can not send PROXY protocol headers",
+			"PROXY protocol headers are not supported by the socat engine",
+			"UDP port mapping 53:10.0.0.2:53/udp can not accept PROXY protocol headers",
+			"PROXY protocol listeners are not supported by the socat engine",
+		}, errsStrs)
+	})
+
+	t.Run("access", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+access:
+  - deny 10.66.0.0/16
+ports:
+  web:
+    mapping: "80:nginx:8080"
+  db:
+    mapping: "5432:db:5432"
+    access:
+      - allow 10.0.0.0/8
+      - deny all
+`)
+		settings, errs := LoadSettings(path)
+		if !assert.Empty(t, errs) {
+			return
+		}
+		for _, port := range settings.Ports {
+			var rulesStrs []string
+			for _, rule := range settings.accessRulesFor(port) {
+				rulesStrs = append(rulesStrs, rule.String())
+			}
+			switch port.Key {
+			case "web":
+				assert.Equal(t, []string{"deny 10.66.0.0/16"}, rulesStrs)
+			case "db":
+				assert.Equal(t, []string{"allow 10.0.0.0/8", "deny all", "deny 10.66.0.0/16"}, rulesStrs)
+			}
+		}
+
+		path = writeConfigFile(t, "config.yaml", `
+access: [allow 10.0.0.0/33]
+ports:
+  db:
+    mapping: "5432:db:5432"
+    access: [permit all]
+`)
+		_, errs = LoadSettings(path)
+		var errsStrs []string
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"invalid ACCESS_RULES: invalid access rule \"allow 10.0.0.0/33\": invalid IP address or CIDR \"10.0.0.0/33\"",
+			"invalid port mapping \"db\" on config file: invalid access rule \"permit all\", must be \"allow\" or \"deny\" followed by an IP address, CIDR or \"all\"",
+		}, errsStrs)
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+access: [deny 10.66.0.0/16]
+ports:
+  web: "80:nginx:8080"
+`)
+		_, errs = LoadSettings(path)
+		assert.Len(t, errs, 1)
+		assert.EqualError(t, errs[0], "client access rules are not supported by the socat engine")
+	})
+
+	t.Run("limits", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+ports:
+  web:
+    mapping: "80:nginx:8080"
+    limits:
+      max_connections: 100
+      max_connections_per_client: 10
+  db:
+    mapping: "5432:db:5432"
+    limits:
+      max_connections: 20
+      on_limit: queue
+`)
+		settings, errs := LoadSettings(path)
+		if !assert.Empty(t, errs) {
+			return
+		}
+		for _, port := range settings.Ports {
+			switch port.Key {
+			case "web":
+				assert.Equal(t, &ConnectionLimits{MaxConnections: 100, MaxConnectionsPerClient: 10}, port.Limits)
+			case "db":
+				assert.Equal(t, &ConnectionLimits{MaxConnections: 20, Queue: true, QueueTimeout: DefaultQueueTimeout}, port.Limits)
+			}
+		}
+
+		path = writeConfigFile(t, "config.yaml", `
+ports:
+  a:
+    mapping: "80:nginx:8080"
+    limits:
+      on_limit: queue
+  b:
+    mapping: "81:nginx:8080"
+    limits:
+      max_connections: 10
+      on_limit: wait
+  c:
+    mapping: "82:nginx:8080"
+    limits:
+      max_connections: 10
+      queue_timeout: 5s
+  d:
+    mapping: "83:nginx:8080"
+    limits:
+      max_connections: 10
+      on_limit: queue
+      queue_timeout: 0s
+`)
+		_, errs = LoadSettings(path)
+		var errsStrs []string
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"invalid port mapping \"a\" on config file: limits must have max_connections or max_connections_per_client",
+			"invalid port mapping \"b\" on config file: invalid limits on_limit \"wait\", must be reject or queue",
+			"invalid port mapping \"c\" on config file: limits can not have queue_timeout without on_limit: queue",
+			"invalid port mapping \"d\" on config file: invalid limits queue_timeout: must be greater than zero",
+		}, errsStrs)
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+ports:
+  a:
+    mapping: "80:nginx:8080"
+    limits:
+      max_connections: 10
+      on_limit: queue
+  b:
+    mapping: "53:10.0.0.2:53/udp"
+    limits:
+      max_connections_per_client: 10
+  c:
+    mapping: "82:nginx:8080"
+    limits:
+      max_connections: 10
+      on_limit: queue
+      queue_timeout: 5s
+`)
+		_, errs = LoadSettings(path)
+		errsStrs = nil
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"UDP port mapping 53:10.0.0.2:53/udp can not have connection limits",
+			"connection limits per client, or rejecting connections when reached, are not supported by the socat engine",
+			"connection limits queue timeouts are not supported by the socat engine",
+		}, errsStrs)
+	})
+
+	t.Run("bandwidth", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+ports:
+  backup:
+    mapping: "873:backup.example.com:873"
+    bandwidth:
+      mapping:
+        upload: 10M
+        upload_burst: 20M
+      connection:
+        download: 512K
+`)
+		settings, errs := LoadSettings(path)
+		if assert.Empty(t, errs) {
+			assert.Equal(t, &BandwidthLimits{
+				MappingUpload:      RateLimit{Rate: 10 * 1024 * 1024, Burst: 20 * 1024 * 1024},
+				ConnectionDownload: RateLimit{Rate: 512 * 1024},
+			}, settings.Ports[0].Bandwidth)
+		}
+
+		path = writeConfigFile(t, "config.yaml", `
+ports:
+  a:
+    mapping: "80:nginx:8080"
+    bandwidth: {}
+  b:
+    mapping: "81:nginx:8080"
+    bandwidth:
+      connection:
+        download_burst: 1M
+  c:
+    mapping: "82:nginx:8080"
+    bandwidth:
+      mapping:
+        upload: 10 MB/s
+`)
+		_, errs = LoadSettings(path)
+		var errsStrs []string
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"invalid port mapping \"a\" on config file: bandwidth must have an upload or download limit",
+			"invalid port mapping \"b\" on config file: bandwidth connection can not have download_burst without download",
+			"invalid port mapping \"c\" on config file: invalid bandwidth mapping upload: invalid size \"10 MB/s\", must be a positive number of bytes, optionally with a K, M or G suffix",
+		}, errsStrs)
+
+		path = writeConfigFile(t, "config.yaml", `
+engine: socat
+ports:
+  dns:
+    mapping: "53:10.0.0.2:53/udp"
+    bandwidth:
+      mapping:
+        download: 1M
+`)
+		_, errs = LoadSettings(path)
+		errsStrs = nil
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"UDP port mapping 53:10.0.0.2:53/udp can not have bandwidth limits",
+			"bandwidth limits are not supported by the socat engine",
+		}, errsStrs)
+	})
+
+	t.Run("target_tls", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+ports:
+  db:
+    mapping: "5432:db.internal:5432"
+    target_tls:
+      server_name: db.example.com
+      ca: /certs/ca.crt
+      cert: /certs/client.crt
+      key: /certs/client.key
+  api:
+    target: "api:443"
+    target_tls:
+      insecure_skip_verify: true
+`)
+		settings, errs := LoadSettings(path)
+		if !assert.Empty(t, errs) {
+			return
+		}
+		for _, port := range settings.Ports {
+			switch port.Key {
+			case "db":
+				assert.Equal(t, &TargetTLS{
+					ServerName: "db.example.com",
+					CAFile:     "/certs/ca.crt",
+					CertFile:   "/certs/client.crt",
+					KeyFile:    "/certs/client.key",
+				}, port.TargetTLS)
+			case "api":
+				assert.Equal(t, &TargetTLS{InsecureSkipVerify: true}, port.TargetTLS)
+			}
+		}
+
+		path = writeConfigFile(t, "config.yaml", `
+ports:
+  db:
+    mapping: "5432:db.internal:5432"
+    target_tls:
+      cert: /certs/client.crt
+`)
+		_, errs = LoadSettings(path)
+		if assert.Len(t, errs, 1) {
+			assert.Equal(t, "invalid port mapping \"db\" on config file: target_tls must have both cert and key, or none of them", errs[0].Error())
+		}
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		path := writeConfigFile(t, "config.yaml", `
+engine: netcat
+ports:
+  a: "8080:nginx"
+  b:
+    listen: 8080
+  c:
+    mapping: "8080:nginx:80"
+    target: "nginx:80"
+`)
+		_, errs := LoadSettings(path)
+		var errsStrs []string
+		for _, err := range errs {
+			errsStrs = append(errsStrs, err.Error())
+		}
+		assert.ElementsMatch(t, []string{
+			"invalid engine \"netcat\", must be one of: native, socat",
+			"invalid port mapping \"a\" on config file: invalid REMOTE port: strconv.ParseInt: parsing \"nginx\": invalid syntax",
+			"invalid port mapping \"b\" on config file: should at least contain a target (REMOTE_HOST:REMOTE_PORT)",
+			"invalid port mapping \"c\" on config file: mapping can not be combined with listen, target or protocol",
+		}, errsStrs)
+
+		path = writeConfigFile(t, "config.yaml", "ports:\n  web:\n    remote: nginx:80\n")
+		_, errs = LoadSettings(path)
+		assert.Len(t, errs, 1)
+		assert.Contains(t, errs[0].Error(), "field remote not found")
+	})
+}
@@ -0,0 +1,364 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var noDeadline time.Time
+
+// Dialer opens outbound connections towards the remote host of a port mapping
+type Dialer interface {
+	DialContext(ctx context.Context, network string, address string) (net.Conn, error)
+}
+
+// newDialer returns the dialer for connecting through the given proxy (or proxy chain), or directly if no proxy given
+func newDialer(proxy *Proxy) Dialer {
+	var dialer Dialer = &net.Dialer{Timeout: DialTimeout}
+	chained := proxy != nil && proxy.Next != nil
+
+	// Each hop of a chain connects to the next one through the previous hops
+	hopsKey := ""
+	for i := 1; proxy != nil; i++ {
+		hopsKey = proxyHopKey(hopsKey, proxy)
+
+		hop := proxyHop{
+			proxy:   proxy,
+			name:    fmt.Sprintf("%s proxy %s", proxy.Scheme, net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port))),
+			forward: dialer,
+		}
+		if chained {
+			hop.name = fmt.Sprintf("hop %d (%s)", i, hop.name)
+		}
+
+		switch proxy.Scheme {
+		case ProxySchemeSocks5:
+			dialer = &socks5Dialer{hop}
+		case ProxySchemeHttp, ProxySchemeHttps:
+			dialer = &httpConnectDialer{hop}
+		case ProxySchemeSsh:
+			dialer = getSshDialer(hopsKey, hop)
+		default:
+			dialer = &socks4aDialer{hop}
+		}
+		proxy = proxy.Next
+	}
+	return dialer
+}
+
+// proxyHopKey identifies a hop of a proxy chain, along with the previous hops (identified by the given key)
+func proxyHopKey(previousKey string, proxy *Proxy) string {
+	hopProxy := *proxy
+	hopProxy.Next = nil
+	return previousKey + fmt.Sprintf("%+v;", hopProxy)
+}
+
+// sshDialerKeys returns the keys of the SSH dialers used for connecting through the given proxy (or proxy chain)
+func sshDialerKeys(proxy *Proxy) (keys []string) {
+	key := ""
+	for ; proxy != nil; proxy = proxy.Next {
+		key = proxyHopKey(key, proxy)
+		if proxy.Scheme == ProxySchemeSsh {
+			keys = append(keys, key)
+		}
+	}
+	return
+}
+
+// proxyHop is a proxy to connect through, reached with the forward dialer
+type proxyHop struct {
+	proxy   *Proxy
+	name    string // describes the proxy on errors
+	forward Dialer
+}
+
+// dialProxy connects to the proxy, and runs the handshake for connecting to the given address through it
+func (h *proxyHop) dialProxy(ctx context.Context, network string, address string, handshake func(conn net.Conn, host string, port uint16) error) (net.Conn, error) {
+	proxy := h.proxy
+	host, portStr, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("invalid port: %s", err)
+	}
+
+	proxyAddress := net.JoinHostPort(proxy.Host, strconv.Itoa(proxy.Port))
+	conn, err := h.forward.DialContext(ctx, network, proxyAddress)
+	if err != nil {
+		if _, ok := h.forward.(*net.Dialer); !ok {
+			// Failed on a previous hop of the chain, already named on the error
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not connect to %s: %s", h.name, err)
+	}
+	if proxy.Scheme == ProxySchemeHttps {
+		// The TLS handshake with the proxy is performed on the first write of the proxy handshake
+		conn = tls.Client(conn, &tls.Config{ServerName: proxy.Host})
+	}
+
+	// Abort the handshake if the context is done before it finishes
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+		defer conn.SetDeadline(noDeadline)
+	}
+
+	err = handshake(conn, host, uint16(port))
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("handshake with %s failed: %s", h.name, err)
+	}
+
+	return conn, nil
+}
+
+// socks4aDialer connects to the remote through a SOCKS4A proxy, letting the proxy resolve hostnames
+type socks4aDialer struct {
+	proxyHop
+}
+
+const (
+	socks4Version        = 0x04
+	socks4CmdConnect     = 0x01
+	socks4ReplyGranted   = 0x5a
+	socks4ReplyLength    = 8
+	socks4aInvalidIpLast = 0x01
+)
+
+func (d *socks4aDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.dialProxy(ctx, network, address, socks4aHandshake)
+}
+
+func socks4aHandshake(conn net.Conn, host string, port uint16) error {
+	// VN CD DSTPORT(2) DSTIP(4) USERID NULL [HOSTNAME NULL]
+	request := []byte{socks4Version, socks4CmdConnect, 0, 0}
+	binary.BigEndian.PutUint16(request[2:], port)
+
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		request = append(request, ip...)
+		request = append(request, 0)
+	} else {
+		request = append(request, 0, 0, 0, socks4aInvalidIpLast, 0)
+		request = append(request, []byte(host)...)
+		request = append(request, 0)
+	}
+
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	reply := make([]byte, socks4ReplyLength)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[1] != socks4ReplyGranted {
+		return fmt.Errorf("request rejected by proxy (code %d)", reply[1])
+	}
+
+	return nil
+}
+
+// socks5Dialer connects to the remote through a SOCKS5 proxy, with optional username/password authentication,
+// letting the proxy resolve hostnames
+type socks5Dialer struct {
+	proxyHop
+}
+
+const (
+	socks5Version           = 0x05
+	socks5AuthNone          = 0x00
+	socks5AuthUserPass      = 0x02
+	socks5AuthNoAcceptable  = 0xff
+	socks5UserPassVersion   = 0x01
+	socks5CmdConnect        = 0x01
+	socks5AddressIpv4       = 0x01
+	socks5AddressDomain     = 0x03
+	socks5AddressIpv6       = 0x04
+	socks5ReplySucceeded    = 0x00
+	socks5MaxFieldLength    = 255
+	socks5ReplyHeaderLength = 4
+	socks5ReplyPortLength   = 2
+)
+
+var socks5ReplyMessages = map[byte]string{
+	0x01: "general SOCKS server failure",
+	0x02: "connection not allowed by ruleset",
+	0x03: "network unreachable",
+	0x04: "host unreachable",
+	0x05: "connection refused",
+	0x06: "TTL expired",
+	0x07: "command not supported",
+	0x08: "address type not supported",
+}
+
+func (d *socks5Dialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.dialProxy(ctx, network, address, func(conn net.Conn, host string, port uint16) error {
+		return socks5Handshake(conn, d.proxy.Username, d.proxy.Password, host, port)
+	})
+}
+
+func socks5Handshake(conn net.Conn, username string, password string, host string, port uint16) error {
+	// Method selection
+	method := byte(socks5AuthNone)
+	if username != "" {
+		method = socks5AuthUserPass
+	}
+	if _, err := conn.Write([]byte{socks5Version, 1, method}); err != nil {
+		return err
+	}
+
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		return err
+	}
+	if reply[0] != socks5Version {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	if reply[1] == socks5AuthNoAcceptable || reply[1] != method {
+		if method == socks5AuthNone {
+			return fmt.Errorf("proxy requires authentication")
+		}
+		return fmt.Errorf("proxy does not support username/password authentication")
+	}
+
+	// Username/password authentication (RFC 1929)
+	if method == socks5AuthUserPass {
+		if len(username) > socks5MaxFieldLength || len(password) > socks5MaxFieldLength {
+			return fmt.Errorf("username or password too long")
+		}
+		request := []byte{socks5UserPassVersion, byte(len(username))}
+		request = append(request, username...)
+		request = append(request, byte(len(password)))
+		request = append(request, password...)
+		if _, err := conn.Write(request); err != nil {
+			return err
+		}
+
+		if _, err := io.ReadFull(conn, reply); err != nil {
+			return err
+		}
+		if reply[1] != socks5ReplySucceeded {
+			return fmt.Errorf("authentication rejected by proxy")
+		}
+	}
+
+	// Connect request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := []byte{socks5Version, socks5CmdConnect, 0}
+	if ip := net.ParseIP(host); ip != nil && ip.To4() != nil {
+		request = append(request, socks5AddressIpv4)
+		request = append(request, ip.To4()...)
+	} else if ip != nil {
+		request = append(request, socks5AddressIpv6)
+		request = append(request, ip.To16()...)
+	} else {
+		if len(host) > socks5MaxFieldLength {
+			return fmt.Errorf("hostname too long")
+		}
+		request = append(request, socks5AddressDomain, byte(len(host)))
+		request = append(request, host...)
+	}
+	request = append(request, 0, 0)
+	binary.BigEndian.PutUint16(request[len(request)-2:], port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	// Reply: VER REP RSV ATYP BND.ADDR BND.PORT
+	header := make([]byte, socks5ReplyHeaderLength)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[1] != socks5ReplySucceeded {
+		message, ok := socks5ReplyMessages[header[1]]
+		if !ok {
+			message = "unknown error"
+		}
+		return fmt.Errorf("request rejected by proxy: %s (code %d)", message, header[1])
+	}
+
+	var addressLength int
+	switch header[3] {
+	case socks5AddressIpv4:
+		addressLength = net.IPv4len
+	case socks5AddressIpv6:
+		addressLength = net.IPv6len
+	case socks5AddressDomain:
+		length := make([]byte, 1)
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		addressLength = int(length[0])
+	default:
+		return fmt.Errorf("unexpected address type %d on proxy reply", header[3])
+	}
+
+	// The bound address is not used
+	_, err := io.ReadFull(conn, make([]byte, addressLength+socks5ReplyPortLength))
+	return err
+}
+
+// httpConnectDialer connects to the remote through an HTTP proxy, using the CONNECT method,
+// with optional Basic authentication and TLS towards the proxy
+type httpConnectDialer struct {
+	proxyHop
+}
+
+// httpMaxResponseHeaderLength limits the size of the response to a CONNECT request
+const httpMaxResponseHeaderLength = 16 * 1024
+
+func (d *httpConnectDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	return d.dialProxy(ctx, network, address, func(conn net.Conn, host string, port uint16) error {
+		return httpConnectHandshake(conn, d.proxy.Username, d.proxy.Password, host, port)
+	})
+}
+
+func httpConnectHandshake(conn net.Conn, username string, password string, host string, port uint16) error {
+	target := net.JoinHostPort(host, strconv.Itoa(int(port)))
+	request := fmt.Sprintf("CONNECT %s HTTP/1.1\r\nHost: %s\r\n", target, target)
+	if username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(username + ":" + password))
+		request += fmt.Sprintf("Proxy-Authorization: Basic %s\r\n", credentials)
+	}
+	request += "\r\n"
+	if _, err := io.WriteString(conn, request); err != nil {
+		return err
+	}
+
+	// The response is read byte by byte, for not consuming any data sent by the remote after the response
+	var response []byte
+	buffer := make([]byte, 1)
+	for !bytes.HasSuffix(response, []byte("\r\n\r\n")) {
+		if len(response) >= httpMaxResponseHeaderLength {
+			return fmt.Errorf("response from proxy too long")
+		}
+		if _, err := io.ReadFull(conn, buffer); err != nil {
+			return err
+		}
+		response = append(response, buffer[0])
+	}
+
+	// Status line: HTTP/1.1 200 Connection established
+	statusLine := strings.SplitN(string(response), "\r\n", 2)[0]
+	statusChunks := strings.SplitN(statusLine, " ", 3)
+	if len(statusChunks) < 2 || !strings.HasPrefix(statusChunks[0], "HTTP/") {
+		return fmt.Errorf("malformed response from proxy: %q", statusLine)
+	}
+	status, err := strconv.Atoi(statusChunks[1])
+	if err != nil {
+		return fmt.Errorf("malformed response from proxy: %q", statusLine)
+	}
+	if status < 200 || status > 299 {
+		return fmt.Errorf("request rejected by proxy: %s", strings.Join(statusChunks[1:], " "))
+	}
+	return nil
+}
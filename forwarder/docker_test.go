@@ -132,7 +132,7 @@ func startTorProxyContainer() error {
 	return runContainer(DockerTestTorproxyContainerName, "dperson/torproxy")
 }
 
-func startPortForwardContainer(name string, ports []PortForward, portsRanges []PortRangeForward, proxy *SocksProxy, exposePorts bool) error {
+func startPortForwardContainer(name string, ports []PortForward, portsRanges []PortRangeForward, proxy *Proxy, exposePorts bool) error {
 	var args []string
 	for i, port := range ports {
 		envName := fmt.Sprintf("PORT%d", i)
@@ -287,7 +287,7 @@ func TestProxyForwardIntegration(t *testing.T) {
 		RemoteHost: remoteHost,
 		RemotePort: 80,
 	}
-	proxy := SocksProxy{
+	proxy := Proxy{
 		Host: DockerTestTorproxyContainerName,
 		Port: DockerTestTorproxyPort,
 	}
@@ -1,55 +1,50 @@
 package main
 
 import (
-	"fmt"
-	"os/exec"
-	"sync"
+	"context"
+	"time"
 )
 
-func getPortForwardArgs(port *PortForward) []string {
-	// socat TCP-LISTEN:80,fork TCP:202.54.1.5:80
-	localChunk := fmt.Sprintf("TCP-LISTEN:%d,fork", port.LocalPort)
-	remoteChunk := fmt.Sprintf("TCP:%s:%d", port.RemoteHost, port.RemotePort)
-	return []string{localChunk, remoteChunk}
+// Forwarder serves a single port mapping, blocking until it fails or the context is cancelled
+type Forwarder interface {
+	Serve(ctx context.Context) error
 }
 
-func getPortForwardSocksProxyArgs(port *PortForward, proxy *SocksProxy) []string {
-	// socat TCP-LISTEN:80,fork SOCKS4A:localhost:202.54.1.5:80,socksport=10000 (being proxy @ localhost:10000)
-	localChunk := fmt.Sprintf("TCP-LISTEN:%d,fork", port.LocalPort)
-	remoteChunk := fmt.Sprintf("SOCKS4A:%s:%s:%d,socksport=%d", proxy.Host, port.RemoteHost, port.RemotePort, proxy.Port)
-	return []string{localChunk, remoteChunk}
+// bandwidthUpdater is implemented by the forwarders able to apply new bandwidth limits without restarting
+type bandwidthUpdater interface {
+	updateBandwidth(limits *BandwidthLimits)
 }
 
-func forwardPort(port *PortForward, socksProxy *SocksProxy) {
-	fmt.Printf("Forwarding port %s ...\n", port.ToString())
+// drainTimeoutUpdater is implemented by the forwarders able to apply a new drain timeout without restarting
+type drainTimeoutUpdater interface {
+	updateDrainTimeout(timeout time.Duration)
+}
 
-	var cmdArgs []string
-	if socksProxy == nil {
-		cmdArgs = getPortForwardArgs(port)
-	} else {
-		cmdArgs = getPortForwardSocksProxyArgs(port, socksProxy)
+func newForwarder(settings *Settings, port *PortForward) Forwarder {
+	proxy := settings.proxyFor(port)
+	if settings.Engine == EngineSocat {
+		return &socatForwarder{
+			port:           port,
+			proxy:          proxy,
+			udpIdleTimeout: settings.UdpIdleTimeout,
+			dualStack:      ipv6Supported(),
+			drainTimeout:   settings.DrainTimeout,
+		}
 	}
 
-	cmd := exec.Command("socat", cmdArgs...)
-	_, err := cmd.Output()
-	if err != nil {
-		fmt.Printf("Port forward for mapping %s failed with error: %s\n", port.ToString(), err.Error())
-	} else {
-		fmt.Printf("Port forward for mapping %s closed without error\n", port.ToString())
+	if port.Protocol == ProtocolUDP {
+		return &udpRelay{
+			port:        port,
+			access:      settings.accessRulesFor(port),
+			idleTimeout: settings.UdpIdleTimeout,
+		}
 	}
-}
-
-func ForwardPorts(settings *Settings) {
-	var waitGroup sync.WaitGroup
 
-	for _, port := range settings.Ports {
-		waitGroup.Add(1)
-
-		go func(port *PortForward) {
-			defer waitGroup.Done()
-			forwardPort(port, settings.SocksProxy)
-		}(port)
+	return &tcpRelay{
+		port:         port,
+		dialer:       newDialer(proxy),
+		access:       settings.accessRulesFor(port),
+		bandwidth:    newBandwidthLimiter(port.Bandwidth),
+		drainTimeout: settings.DrainTimeout,
 	}
-
-	waitGroup.Wait()
 }
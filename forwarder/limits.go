@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+)
+
+// DefaultQueueTimeout is the maximum time connections wait for the connection limits, when queuing them
+const DefaultQueueTimeout = 10 * time.Second
+
+// ConnectionLimits caps the concurrent connections of a mapping. When reached, new connections are rejected,
+// or queued until any other connection finishes (rejected if not done within the queue timeout).
+type ConnectionLimits struct {
+	MaxConnections          int // 0 for unlimited
+	MaxConnectionsPerClient int // by client IP address, 0 for unlimited
+	Queue                   bool
+	QueueTimeout            time.Duration
+	QueueTimeoutSet         bool // the queue timeout was given, instead of using the default one
+}
+
+// connLimiter keeps count of the active connections of a mapping, in total and by client IP address
+type connLimiter struct {
+	limits   *ConnectionLimits
+	lock     sync.Mutex
+	active   int
+	clients  map[string]int
+	released chan struct{} // closed when a connection is released, waking up the queued ones
+}
+
+func newConnLimiter(limits *ConnectionLimits) *connLimiter {
+	return &connLimiter{
+		limits:   limits,
+		clients:  make(map[string]int),
+		released: make(chan struct{}),
+	}
+}
+
+// clientIp returns the IP address of the given client address, as string
+func clientIp(addr net.Addr) string {
+	switch addr := addr.(type) {
+	case *net.TCPAddr:
+		return addr.IP.String()
+	case *net.UDPAddr:
+		return addr.IP.String()
+	}
+	return addr.String()
+}
+
+// reachedLimit returns an error describing the limit reached for a new connection of the client, if any
+func (l *connLimiter) reachedLimit(client string) error {
+	if l.limits.MaxConnections > 0 && l.active >= l.limits.MaxConnections {
+		return fmt.Errorf("maximum connections (%d) reached", l.limits.MaxConnections)
+	}
+	if l.limits.MaxConnectionsPerClient > 0 && l.clients[client] >= l.limits.MaxConnectionsPerClient {
+		return fmt.Errorf("maximum connections per client (%d) reached", l.limits.MaxConnectionsPerClient)
+	}
+	return nil
+}
+
+// acquire counts a new connection of the client, returning the function to call when it finishes.
+// If a limit is reached, the connection is either rejected, or waits for other connections to finish;
+// onQueued is called when starting to wait. Returns an error if rejected.
+func (l *connLimiter) acquire(ctx context.Context, client string, onQueued func(reason error)) (func(), error) {
+	var timeout <-chan time.Time
+	for {
+		l.lock.Lock()
+		err := l.reachedLimit(client)
+		if err == nil {
+			l.active++
+			l.clients[client]++
+			l.lock.Unlock()
+			return func() { l.release(client) }, nil
+		}
+		released := l.released
+		l.lock.Unlock()
+
+		if !l.limits.Queue {
+			return nil, err
+		}
+		if timeout == nil {
+			onQueued(err)
+			timer := time.NewTimer(l.limits.QueueTimeout)
+			defer timer.Stop()
+			timeout = timer.C
+		}
+
+		select {
+		case <-released:
+		case <-timeout:
+			return nil, fmt.Errorf("%s, not released within %s", err, l.limits.QueueTimeout)
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *connLimiter) release(client string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	l.active--
+	if l.clients[client]--; l.clients[client] == 0 {
+		delete(l.clients, client)
+	}
+	close(l.released)
+	l.released = make(chan struct{})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimiter(t *testing.T) {
+	ctx := context.Background()
+	notQueued := func(reason error) {
+		t.Errorf("unexpected queuing: %s", reason)
+	}
+
+	limiter := newConnLimiter(&ConnectionLimits{MaxConnections: 3, MaxConnectionsPerClient: 2})
+	releaseA1, err := limiter.acquire(ctx, "10.0.0.1", notQueued)
+	assert.Nil(t, err)
+	_, err = limiter.acquire(ctx, "10.0.0.1", notQueued)
+	assert.Nil(t, err)
+	_, err = limiter.acquire(ctx, "10.0.0.1", notQueued)
+	assert.EqualError(t, err, "maximum connections per client (2) reached")
+	_, err = limiter.acquire(ctx, "10.0.0.2", notQueued)
+	assert.Nil(t, err)
+	_, err = limiter.acquire(ctx, "10.0.0.3", notQueued)
+	assert.EqualError(t, err, "maximum connections (3) reached")
+
+	releaseA1()
+	_, err = limiter.acquire(ctx, "10.0.0.3", notQueued)
+	assert.Nil(t, err)
+}
+
+func TestConnLimiterQueue(t *testing.T) {
+	ctx := context.Background()
+	var queued []string
+	onQueued := func(reason error) {
+		queued = append(queued, reason.Error())
+	}
+
+	limiter := newConnLimiter(&ConnectionLimits{MaxConnections: 1, Queue: true, QueueTimeout: 200 * time.Millisecond})
+	release, err := limiter.acquire(ctx, "10.0.0.1", onQueued)
+	assert.Nil(t, err)
+
+	// Waits until the active connection finishes
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		release()
+	}()
+	start := time.Now()
+	release, err = limiter.acquire(ctx, "10.0.0.2", onQueued)
+	assert.Nil(t, err)
+	assert.GreaterOrEqual(t, int64(time.Since(start)), int64(50*time.Millisecond))
+	assert.Equal(t, []string{"maximum connections (1) reached"}, queued)
+
+	// Rejected if not finished within the queue timeout
+	_, err = limiter.acquire(ctx, "10.0.0.3", onQueued)
+	assert.EqualError(t, err, "maximum connections (1) reached, not released within 200ms")
+	assert.Len(t, queued, 2)
+
+	// or when the context is done
+	cancelledCtx, cancel := context.WithCancel(ctx)
+	cancel()
+	_, err = limiter.acquire(cancelledCtx, "10.0.0.3", onQueued)
+	assert.Equal(t, context.Canceled, err)
+
+	release()
+	_, err = limiter.acquire(ctx, "10.0.0.3", onQueued)
+	assert.Nil(t, err)
+}
+
+func TestTcpRelayConnectionLimits(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+	relay := &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+			Limits:     &ConnectionLimits{MaxConnectionsPerClient: 1},
+		},
+		dialer:  newDialer(nil),
+		metrics: &forwardMetrics{}, // read by the test while serving
+	}
+	startRelay(t, relay)
+
+	first, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer first.Close()
+	_, _ = fmt.Fprintf(first, "first\n")
+	_, err = bufio.NewReader(first).ReadString('\n')
+	assert.Nil(t, err)
+
+	// Rejected while the first connection is active
+	second, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer second.Close()
+	_, _ = fmt.Fprintf(second, "second\n")
+	_ = second.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = bufio.NewReader(second).ReadString('\n')
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&relay.metrics.limitedConnections))
+
+	_ = first.Close()
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&relay.metrics.activeConnections) == 0
+	}, time.Second, RelayTestThinktime/10)
+	assertEcho(t, localPort, "after the first one finished")
+}
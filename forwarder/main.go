@@ -1,20 +1,91 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
+// Exit status codes
+const (
+	ExitCodeError        = 1
+	ExitCodeDrainTimeout = 2
+)
+
+// handleSignals cancels the returned context when a termination signal is received,
+// exiting immediately (killing the child processes) if a second one is received while shutting down.
+// Other signals are passed on to the child processes.
+func handleSignals() context.Context {
+	ctx, cancel := context.WithCancel(context.Background())
+	terminationSignals := make(chan os.Signal, 2)
+	signal.Notify(terminationSignals, syscall.SIGTERM, syscall.SIGINT)
+	if len(forwardedSignals) > 0 {
+		otherSignals := make(chan os.Signal, 1)
+		signal.Notify(otherSignals, forwardedSignals...)
+
+		go func() {
+			for sig := range otherSignals {
+				childProcesses.signalAll(sig.(syscall.Signal))
+			}
+		}()
+	}
+
+	go func() {
+		sig := <-terminationSignals
+		fmt.Printf("Received signal %s, stopping (send again to exit immediately) ...\n", sig)
+		cancel()
+
+		sig = <-terminationSignals
+		fmt.Printf("Received signal %s, exiting now\n", sig)
+		exit(ExitCodeError)
+	}()
+
+	return ctx
+}
+
+// exit terminates the process with the given status code, killing the child processes left
+func exit(code int) {
+	childProcesses.signalAll(syscall.SIGKILL)
+	os.Exit(code)
+}
+
 func main() {
-	settings, errors := LoadSettings()
+	configFile := flag.String("config", "", "path to the YAML/JSON config file (alternative to the CONFIG_FILE env var)")
+	flag.Parse()
+
+	settings, errors := LoadSettings(*configFile)
 	if errors != nil {
 		fmt.Println("Errors in settings:")
 		for _, err := range errors {
 			fmt.Println(err.Error())
 		}
 
-		os.Exit(1)
+		os.Exit(ExitCodeError)
+	}
+
+	startReaper()
+	ctx := handleSignals()
+	manager := NewManager(settings)
+	watchReloads(ctx, manager, settings.ConfigFile)
+	if settings.AdminAddress != "" {
+		startAdminServer(ctx, settings.AdminAddress, settings.AdminToken, manager)
+	}
+	if settings.MetricsAddress != "" {
+		startMetricsServer(ctx, settings.MetricsAddress)
+	}
+
+	err := manager.Run(ctx)
+	if err == ErrDrainTimeout {
+		fmt.Println("Stopped:", err.Error())
+		exit(ExitCodeDrainTimeout)
+	}
+	if err != nil {
+		fmt.Println("Exiting:", err.Error())
+		exit(ExitCodeError)
 	}
 
-	ForwardPorts(settings)
+	fmt.Println("Stopped gracefully")
 }
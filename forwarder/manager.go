@@ -0,0 +1,412 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Manager runs the forwarders of all the port mappings, allowing to change them at runtime
+type Manager struct {
+	settings     *Settings
+	forwards     map[string]*managedForward // by listener id
+	runtimePorts map[string]*PortForward    // added at runtime (admin API), kept on reloads; by listener id
+
+	ctx           context.Context
+	cancel        context.CancelFunc
+	waitGroup     sync.WaitGroup
+	fatalErr      error
+	drainTimedOut bool
+	lock          sync.Mutex
+	reloadLock    sync.Mutex
+}
+
+// managedForward is a port mapping being served by the manager
+type managedForward struct {
+	port       *PortForward
+	supervisor *supervisor
+	cancel     context.CancelFunc
+	done       chan struct{}
+	failed     bool
+}
+
+// ListenerId identifies the local listener of the mapping; two mappings can not share it
+func (p *PortForward) ListenerId() string {
+	if p.LocalHost != "" {
+		return fmt.Sprintf("%s:%d/%s", formatHost(p.LocalHost), p.LocalPort, p.Protocol)
+	}
+	return fmt.Sprintf("%d/%s", p.LocalPort, p.Protocol)
+}
+
+func NewManager(settings *Settings) *Manager {
+	return &Manager{
+		settings:     settings,
+		forwards:     make(map[string]*managedForward),
+		runtimePorts: make(map[string]*PortForward),
+	}
+}
+
+// Run serves all the port mappings, restarting them when they fail, until the context is cancelled.
+// Returns an error if the process should exit due to the forwards failing (according to the exit policy),
+// or ErrDrainTimeout if, being stopped, active connections had to be closed.
+func (m *Manager) Run(ctx context.Context) error {
+	rand.Seed(time.Now().UnixNano())
+
+	m.lock.Lock()
+	m.ctx, m.cancel = context.WithCancel(ctx)
+	defer m.cancel()
+
+	fmt.Printf("Forwarding %d ports (engine: %s) ...\n", len(m.settings.Ports), m.settings.Engine)
+	for _, port := range m.settings.Ports {
+		m.start(port)
+	}
+	m.lock.Unlock()
+
+	<-m.ctx.Done()
+	m.waitGroup.Wait()
+	evictSshDialers(nil)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.fatalErr != nil {
+		return m.fatalErr
+	}
+	if m.drainTimedOut {
+		return ErrDrainTimeout
+	}
+	return nil
+}
+
+// start runs the supervised forwarder of the port mapping in background. Must be called with the manager locked.
+func (m *Manager) start(port *PortForward) {
+	ctx, cancel := context.WithCancel(m.ctx)
+	forward := &managedForward{
+		port: port,
+		supervisor: &supervisor{
+			port:      port,
+			forwarder: newForwarder(m.settings, port),
+			policy:    m.settings.Restart,
+		},
+		cancel: cancel,
+		done:   make(chan struct{}),
+	}
+	m.forwards[port.ListenerId()] = forward
+
+	m.waitGroup.Add(1)
+	go func() {
+		defer m.waitGroup.Done()
+		defer close(forward.done)
+
+		err := forward.supervisor.Run(ctx)
+		if err == ErrDrainTimeout && m.ctx.Err() != nil {
+			m.lock.Lock()
+			m.drainTimedOut = true
+			m.lock.Unlock()
+		} else if err != nil && err != ErrDrainTimeout {
+			fmt.Println(err.Error())
+			m.onFailure(forward, err)
+		}
+	}()
+}
+
+// stop stops the forwarder of the port mapping, waiting for it to finish. Must be called with the manager unlocked.
+func (m *Manager) stop(forward *managedForward) {
+	forward.cancel()
+	<-forward.done
+}
+
+// onFailure handles a port mapping that stopped after reaching the maximum number of restarts,
+// stopping all the forwards if required by the exit policy. Otherwise the manager keeps running
+// (even if all the forwards failed), as failed forwards can be restarted by reloading the settings, or from the admin API.
+func (m *Manager) onFailure(forward *managedForward, err error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	forward.failed = true
+	if m.settings.Restart.ExitPolicy == ExitPolicyExit {
+		m.fatal(err)
+	}
+}
+
+// evictUnusedSshDialers closes the SSH sessions not used by the current forwards. Must be called with the manager locked.
+func (m *Manager) evictUnusedSshDialers() {
+	used := make(map[string]bool)
+	for _, forward := range m.forwards {
+		for _, key := range sshDialerKeys(m.settings.proxyFor(forward.port)) {
+			used[key] = true
+		}
+	}
+	evictSshDialers(used)
+}
+
+// fatal stops all the forwards, making Run return the given error. Must be called with the manager locked.
+func (m *Manager) fatal(err error) {
+	if m.fatalErr == nil {
+		m.fatalErr = err
+	}
+	m.cancel()
+}
+
+// sameForwarderInputs returns whether the settings apply the same to the forwarder of the port mapping,
+// comparing only what the forwarder is built from (the proxy, access rules, engine and UDP idle timeout)
+func sameForwarderInputs(oldSettings *Settings, newSettings *Settings, oldPort *PortForward, newPort *PortForward) bool {
+	if oldSettings.Engine != newSettings.Engine {
+		return false
+	}
+	if newPort.Protocol == ProtocolUDP && oldSettings.UdpIdleTimeout != newSettings.UdpIdleTimeout {
+		return false
+	}
+	return reflect.DeepEqual(oldSettings.proxyFor(oldPort), newSettings.proxyFor(newPort)) &&
+		reflect.DeepEqual(oldSettings.accessRulesFor(oldPort), newSettings.accessRulesFor(newPort))
+}
+
+// updatePolicies applies the restart policy and drain timeout of the settings to the running forwarder.
+// Must be called with the manager locked.
+func updatePolicies(forward *managedForward, settings *Settings) {
+	forward.supervisor.setPolicy(settings.Restart)
+	if updater, ok := forward.supervisor.forwarder.(drainTimeoutUpdater); ok {
+		updater.updateDrainTimeout(settings.DrainTimeout)
+	}
+}
+
+// updateBandwidth applies the bandwidth limits of the new port mapping to the running forwarder,
+// if the mapping only changed on them. Returns false if the forwarder must be restarted for applying the changes.
+// Must be called with the manager locked.
+func updateBandwidth(forward *managedForward, newPort *PortForward) bool {
+	updater, ok := forward.supervisor.forwarder.(bandwidthUpdater)
+	oldPortCopy, newPortCopy := *forward.port, *newPort
+	oldPortCopy.Bandwidth, newPortCopy.Bandwidth = nil, nil
+	if !ok || !reflect.DeepEqual(oldPortCopy, newPortCopy) {
+		return false
+	}
+
+	updater.updateBandwidth(newPort.Bandwidth)
+	forward.port = newPort
+	fmt.Printf("Updated bandwidth limits of port forward %s\n", newPort.ToString())
+	return true
+}
+
+// Reload applies the new settings, starting the added port mappings, and stopping the removed ones.
+// Changed mappings are restarted (unless only changing their bandwidth limits, applied to the running forwarder),
+// as well as the ones affected by changes on the global settings (proxy, access rules, engine, UDP idle timeout),
+// while unchanged ones (with their active connections) keep running, only applying the new restart policy and drain timeout
+// (except failed ones, which are restarted).
+// Returns the validation errors, without applying the settings, if they conflict with the mappings added at runtime.
+func (m *Manager) Reload(settings *Settings) (errors []error) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	m.lock.Lock()
+	if m.ctx == nil || m.ctx.Err() != nil {
+		// Not running
+		m.lock.Unlock()
+		return nil
+	}
+
+	newPorts := make(map[string]*PortForward)
+	for _, port := range settings.Ports {
+		newPorts[port.ListenerId()] = port
+	}
+
+	// The mappings added at runtime must not conflict with the new settings
+	candidate := *settings
+	for id, port := range m.runtimePorts {
+		if _, ok := newPorts[id]; !ok {
+			candidate.Ports = append(candidate.Ports, port)
+		}
+	}
+	if errors = validateSettings(&candidate); errors != nil {
+		m.lock.Unlock()
+		return errors
+	}
+	for id, port := range m.runtimePorts {
+		if _, ok := newPorts[id]; ok {
+			delete(m.runtimePorts, id)
+		} else {
+			newPorts[id] = port
+		}
+	}
+
+	var toStop []*managedForward
+	var toStart []*PortForward
+	var added, removed, changed int
+	for id, port := range newPorts {
+		if _, ok := m.forwards[id]; !ok {
+			added++
+			toStart = append(toStart, port)
+		}
+	}
+	for id, forward := range m.forwards {
+		newPort, ok := newPorts[id]
+		sameInputs := ok && !forward.failed && sameForwarderInputs(m.settings, settings, forward.port, newPort)
+		if !ok {
+			removed++
+		} else if sameInputs && reflect.DeepEqual(forward.port, newPort) {
+			updatePolicies(forward, settings)
+			continue
+		} else if sameInputs && updateBandwidth(forward, newPort) {
+			updatePolicies(forward, settings)
+			changed++
+			continue
+		} else {
+			changed++
+			toStart = append(toStart, newPort)
+		}
+
+		toStop = append(toStop, forward)
+		delete(m.forwards, id)
+	}
+	m.lock.Unlock()
+
+	// Stop the forwards before starting the new ones, as they may use the same ports
+	for _, forward := range toStop {
+		fmt.Printf("Stopping port forward %s ...\n", forward.port.ToString())
+		m.stop(forward)
+	}
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.settings = settings
+	if m.ctx.Err() != nil {
+		return nil
+	}
+	for _, port := range toStart {
+		m.start(port)
+	}
+	m.evictUnusedSshDialers()
+
+	unchanged := len(newPorts) - added - changed
+	fmt.Printf("Reloaded settings: %d added, %d removed, %d changed, %d unchanged port forwards\n", added, removed, changed, unchanged)
+	return nil
+}
+
+// ForwardStatus is the current status of a port mapping served by the manager
+type ForwardStatus struct {
+	Id         string `json:"id"`
+	Key        string `json:"key"`
+	Mapping    string `json:"mapping"`
+	Protocol   string `json:"protocol"`
+	LocalHost  string `json:"local_host,omitempty"`
+	LocalPort  int64  `json:"local_port"`
+	RemoteHost string `json:"remote_host"`
+	RemotePort int64  `json:"remote_port"`
+	State      string `json:"state"`
+	Restarts   int    `json:"restarts"`
+}
+
+// List returns the status of all the port mappings, sorted by id
+func (m *Manager) List() []ForwardStatus {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	statuses := make([]ForwardStatus, 0, len(m.forwards))
+	for id, forward := range m.forwards {
+		state, restarts := forward.supervisor.status()
+		statuses = append(statuses, ForwardStatus{
+			Id:         id,
+			Key:        forward.port.Key,
+			Mapping:    forward.port.ToString(),
+			Protocol:   forward.port.Protocol,
+			LocalHost:  forward.port.LocalHost,
+			LocalPort:  forward.port.LocalPort,
+			RemoteHost: forward.port.RemoteHost,
+			RemotePort: forward.port.RemotePort,
+			State:      state,
+			Restarts:   restarts,
+		})
+	}
+
+	sort.Slice(statuses, func(i, j int) bool {
+		return statuses[i].Id < statuses[j].Id
+	})
+	return statuses
+}
+
+// ErrManagerNotRunning is returned when adding port mappings to a manager not running (not started yet, or stopped)
+var ErrManagerNotRunning = fmt.Errorf("port forwards manager not running")
+
+// Add starts forwarding the given port mappings, validated along with the current ones.
+// The mappings are kept when reloading the settings.
+// Returns ErrManagerNotRunning (as only error) if the manager is not running.
+func (m *Manager) Add(ports []*PortForward) (errors []error) {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	if m.ctx == nil || m.ctx.Err() != nil {
+		return []error{ErrManagerNotRunning}
+	}
+
+	candidate := *m.settings
+	candidate.Ports = ports
+	for _, forward := range m.forwards {
+		candidate.Ports = append(candidate.Ports, forward.port)
+	}
+	errors = validateSettings(&candidate)
+	if errors != nil {
+		return
+	}
+
+	for _, port := range ports {
+		m.runtimePorts[port.ListenerId()] = port
+		m.start(port)
+	}
+	return
+}
+
+// ErrForwardNotFound is returned when a port mapping is requested by an unknown id
+var ErrForwardNotFound = fmt.Errorf("port forward not found")
+
+// Remove stops forwarding the port mapping with the given id.
+// Mappings defined on the settings are started again when reloading them.
+func (m *Manager) Remove(id string) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	m.lock.Lock()
+	forward, ok := m.forwards[id]
+	if ok {
+		delete(m.forwards, id)
+		delete(m.runtimePorts, id)
+	}
+	m.lock.Unlock()
+
+	if !ok {
+		return ErrForwardNotFound
+	}
+	fmt.Printf("Stopping port forward %s ...\n", forward.port.ToString())
+	m.stop(forward)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	m.evictUnusedSshDialers()
+	return nil
+}
+
+// Restart stops and starts again the forwarder of the port mapping with the given id (also if failed)
+func (m *Manager) Restart(id string) error {
+	m.reloadLock.Lock()
+	defer m.reloadLock.Unlock()
+
+	m.lock.Lock()
+	forward, ok := m.forwards[id]
+	m.lock.Unlock()
+	if !ok {
+		return ErrForwardNotFound
+	}
+
+	fmt.Printf("Restarting port forward %s ...\n", forward.port.ToString())
+	m.stop(forward)
+
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if m.ctx.Err() == nil {
+		m.start(forward.port)
+	}
+	return nil
+}
@@ -0,0 +1,220 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func managertestSettings(ports ...*PortForward) *Settings {
+	return &Settings{
+		Ports:        ports,
+		Engine:       EngineNative,
+		DrainTimeout: RelayTestThinktime,
+		Restart: RestartPolicy{
+			Backoff:    RelayTestThinktime,
+			BackoffMax: RelayTestThinktime,
+			ExitPolicy: ExitPolicyKeepRunning,
+		},
+	}
+}
+
+func TestManagerReload(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	unchangedPort := &PortForward{Key: "PORT_A", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+	removedPort := &PortForward{Key: "PORT_B", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+	changedPort := &PortForward{Key: "PORT_C", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+
+	manager := NewManager(managertestSettings(unchangedPort, removedPort, changedPort))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- manager.Run(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	// Connection kept open on the unchanged port during the reload
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", unchangedPort.LocalPort))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	newChangedPort := *changedPort
+	newChangedPort.RemoteHost = "localhost"
+	addedPort := &PortForward{Key: "PORT_D", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+	sameUnchangedPort := *unchangedPort
+	manager.Reload(managertestSettings(&sameUnchangedPort, &newChangedPort, addedPort))
+	time.Sleep(RelayTestThinktime)
+
+	_, _ = fmt.Fprintln(conn, "still alive")
+	reply, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "still alive\n", reply)
+
+	assertEcho(t, newChangedPort.LocalPort, "changed")
+	assertEcho(t, addedPort.LocalPort, "added")
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", removedPort.LocalPort))
+	assert.NotNil(t, err)
+
+	manager.lock.Lock()
+	assert.Len(t, manager.forwards, 3)
+	assert.Same(t, unchangedPort, manager.forwards[unchangedPort.ListenerId()].port)
+	assert.Same(t, &newChangedPort, manager.forwards[changedPort.ListenerId()].port)
+	manager.lock.Unlock()
+
+	// The connection left open must be closed after the drain timeout
+	cancel()
+	assert.Equal(t, ErrDrainTimeout, <-result)
+}
+
+func TestManagerReloadBandwidth(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	port := &PortForward{Key: "PORT_A", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+
+	manager := NewManager(managertestSettings(port))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = manager.Run(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	manager.lock.Lock()
+	forward := manager.forwards[port.ListenerId()]
+	manager.lock.Unlock()
+
+	// Changing the bandwidth limits is applied on the running forwarder
+	limitedPort := *port
+	limitedPort.Bandwidth = &BandwidthLimits{ConnectionDownload: RateLimit{Rate: 1000}}
+	manager.Reload(managertestSettings(&limitedPort))
+	manager.lock.Lock()
+	assert.Same(t, forward, manager.forwards[port.ListenerId()])
+	assert.Same(t, &limitedPort, forward.port)
+	manager.lock.Unlock()
+	assert.Equal(t, limitedPort.Bandwidth.ConnectionDownload, forward.supervisor.forwarder.(*tcpRelay).bandwidth.limits.ConnectionDownload)
+
+	// Changing anything else restarts it
+	changedPort := limitedPort
+	changedPort.RemoteHost = "localhost"
+	manager.Reload(managertestSettings(&changedPort))
+	manager.lock.Lock()
+	assert.NotSame(t, forward, manager.forwards[port.ListenerId()])
+	manager.lock.Unlock()
+	time.Sleep(RelayTestThinktime)
+	assertEcho(t, port.LocalPort, "restarted")
+}
+
+func TestManagerReloadGlobalSettings(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	port := &PortForward{Key: "PORT_A", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+
+	manager := NewManager(managertestSettings(port))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = manager.Run(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	manager.lock.Lock()
+	forward := manager.forwards[port.ListenerId()]
+	manager.lock.Unlock()
+
+	// Adding a proxy not used by the mapping, and changing the policies, keeps the forwarder running
+	settings := managertestSettings(port)
+	settings.Proxies = map[string]*Proxy{"other": {Scheme: "socks5", Host: "127.0.0.1", Port: 1080}}
+	settings.UdpIdleTimeout = time.Minute
+	settings.DrainTimeout = time.Minute
+	settings.Restart.MaxRestarts = 3
+	manager.Reload(settings)
+	manager.lock.Lock()
+	assert.Same(t, forward, manager.forwards[port.ListenerId()])
+	manager.lock.Unlock()
+	assert.Equal(t, time.Minute, forward.supervisor.forwarder.(*tcpRelay).drainTimeout)
+	assert.Equal(t, 3, forward.supervisor.policy.MaxRestarts)
+
+	// Changing the access rules applied to the mapping restarts it
+	settings = managertestSettings(port)
+	settings.Access = []*AccessRule{{Allow: true}}
+	manager.Reload(settings)
+	manager.lock.Lock()
+	assert.NotSame(t, forward, manager.forwards[port.ListenerId()])
+	manager.lock.Unlock()
+	time.Sleep(RelayTestThinktime)
+	assertEcho(t, port.LocalPort, "restarted")
+}
+
+func TestManagerReloadRuntimePorts(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	port := &PortForward{Key: "PORT_A", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+
+	manager := NewManager(managertestSettings(port))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		_ = manager.Run(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	addedPort := &PortForward{Key: "admin", LocalPort: getFreePort(t), RemoteHost: "127.0.0.1", RemotePort: remotePort, Protocol: ProtocolTCP}
+	assert.Nil(t, manager.Add([]*PortForward{addedPort}))
+
+	// Settings conflicting with the mappings added at runtime are not applied
+	conflictingPort := *addedPort
+	conflictingPort.Key = "PORT_B"
+	conflictingPort.LocalHost = "127.0.0.1"
+	errs := manager.Reload(managertestSettings(port, &conflictingPort))
+	if assert.Len(t, errs, 1) {
+		assert.Contains(t, errs[0].Error(), "use the same local port")
+	}
+	assert.Len(t, manager.List(), 2)
+	time.Sleep(RelayTestThinktime)
+	assertEcho(t, addedPort.LocalPort, "kept")
+
+	// Mappings on the same listener replace the ones added at runtime
+	replacingPort := *addedPort
+	replacingPort.Key = "PORT_B"
+	assert.Nil(t, manager.Reload(managertestSettings(port, &replacingPort)))
+	manager.lock.Lock()
+	assert.Empty(t, manager.runtimePorts)
+	assert.Same(t, &replacingPort, manager.forwards[addedPort.ListenerId()].port)
+	manager.lock.Unlock()
+}
+
+func TestManagerExitPolicy(t *testing.T) {
+	// Listening on a port already in use fails
+	busyPort := getFreePort(t)
+	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", busyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	settings := managertestSettings(&PortForward{Key: "PORT", LocalPort: busyPort, RemoteHost: "127.0.0.1", RemotePort: 80, Protocol: ProtocolTCP})
+	settings.Restart.MaxRestarts = 1
+	settings.Restart.Backoff = time.Millisecond
+	settings.Restart.BackoffMax = time.Second
+
+	// Failed forwards are kept (not running) until stopped, even if all of them failed
+	ctx, cancel := context.WithTimeout(context.Background(), 5*RelayTestThinktime)
+	defer cancel()
+	manager := NewManager(settings)
+	err = manager.Run(ctx)
+	assert.Nil(t, err)
+	if statuses := manager.List(); assert.Len(t, statuses, 1) {
+		assert.Equal(t, StateFailed, statuses[0].State)
+	}
+
+	settings.Restart.ExitPolicy = ExitPolicyExit
+	err = NewManager(settings).Run(context.Background())
+	assert.EqualError(t, err, fmt.Sprintf("port forward for mapping %d:127.0.0.1:80/tcp reached the maximum of 1 restarts", busyPort))
+}
@@ -0,0 +1,191 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Upper bounds of the dial duration histogram buckets, in seconds
+var dialDurationBuckets = []float64{0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// forwardsMetrics holds the metrics of all the port mappings, exposed in Prometheus format
+var forwardsMetrics = &metricsRegistry{forwards: make(map[string]*forwardMetrics)}
+
+type metricsRegistry struct {
+	forwards map[string]*forwardMetrics // by labels
+	lock     sync.Mutex
+}
+
+// forwardMetrics are the metrics of a single port mapping. Counters are accessed atomically.
+type forwardMetrics struct {
+	labels              string
+	activeConnections   int64
+	acceptedConnections int64
+	bytesIn             int64 // from clients to remote
+	bytesOut            int64 // from remote to clients
+	dialErrors          int64
+	tlsHandshakeErrors  int64
+	proxyProtocolErrors int64
+	deniedConnections   int64
+	limitedConnections  int64 // rejected by the connection limits
+	queuedConnections   int64
+	restarts            int64
+	dialDuration        histogram
+}
+
+// histogram counts observations on cumulative buckets, as Prometheus histograms
+type histogram struct {
+	buckets []float64
+	counts  []int64
+	count   int64
+	sum     float64
+	lock    sync.Mutex
+}
+
+func (h *histogram) observe(value float64) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if h.counts == nil {
+		h.counts = make([]int64, len(h.buckets))
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	h.sum += value
+}
+
+// escapeLabelValue escapes a Prometheus label value
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value)
+}
+
+// forPort returns the metrics of the given port mapping, created if not exists
+func (r *metricsRegistry) forPort(port *PortForward) *forwardMetrics {
+	labels := fmt.Sprintf(`key="%s",protocol="%s",local_host="%s",local_port="%d",remote_host="%s",remote_port="%d"`,
+		escapeLabelValue(port.Key), port.Protocol, escapeLabelValue(port.LocalHost), port.LocalPort, escapeLabelValue(port.RemoteHost), port.RemotePort)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	metrics, ok := r.forwards[labels]
+	if !ok {
+		metrics = &forwardMetrics{
+			labels:       labels,
+			dialDuration: histogram{buckets: dialDurationBuckets},
+		}
+		r.forwards[labels] = metrics
+	}
+	return metrics
+}
+
+// observeDial records the result of a connection attempt towards the remote
+func (m *forwardMetrics) observeDial(start time.Time, err error) {
+	if err != nil {
+		atomic.AddInt64(&m.dialErrors, 1)
+		return
+	}
+	m.dialDuration.observe(time.Since(start).Seconds())
+}
+
+// connectionStarted records a new accepted connection, returning the function to call when it finishes
+func (m *forwardMetrics) connectionStarted() func() {
+	atomic.AddInt64(&m.acceptedConnections, 1)
+	atomic.AddInt64(&m.activeConnections, 1)
+	return func() {
+		atomic.AddInt64(&m.activeConnections, -1)
+	}
+}
+
+type metricDescription struct {
+	name       string
+	metricType string
+	help       string
+	value      func(m *forwardMetrics) int64
+}
+
+var metricsDescriptions = []metricDescription{
+	{"portforward_connections_active", "gauge", "Number of active connections (or UDP sessions)",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.activeConnections) }},
+	{"portforward_connections_total", "counter", "Number of accepted connections (or UDP sessions)",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.acceptedConnections) }},
+	{"portforward_received_bytes_total", "counter", "Bytes received from the clients and sent to the remote",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.bytesIn) }},
+	{"portforward_sent_bytes_total", "counter", "Bytes received from the remote and sent to the clients",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.bytesOut) }},
+	{"portforward_dial_errors_total", "counter", "Number of failed connection attempts to the remote",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.dialErrors) }},
+	{"portforward_tls_handshake_errors_total", "counter", "Number of failed TLS handshakes with clients (including rejected client certificates)",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.tlsHandshakeErrors) }},
+	{"portforward_proxy_protocol_errors_total", "counter", "Number of connections rejected for not sending a valid PROXY protocol header from a trusted source",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.proxyProtocolErrors) }},
+	{"portforward_denied_connections_total", "counter", "Number of connections (or UDP datagrams) denied by the access rules",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.deniedConnections) }},
+	{"portforward_limited_connections_total", "counter", "Number of connections rejected for reaching the connection limits",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.limitedConnections) }},
+	{"portforward_queued_connections_total", "counter", "Number of connections queued for reaching the connection limits",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.queuedConnections) }},
+	{"portforward_restarts_total", "counter", "Number of times the forwarder was restarted after failing",
+		func(m *forwardMetrics) int64 { return atomic.LoadInt64(&m.restarts) }},
+}
+
+// writeMetrics writes all the metrics with the Prometheus text exposition format
+func (r *metricsRegistry) writeMetrics(w io.Writer) {
+	r.lock.Lock()
+	forwards := make([]*forwardMetrics, 0, len(r.forwards))
+	for _, metrics := range r.forwards {
+		forwards = append(forwards, metrics)
+	}
+	r.lock.Unlock()
+
+	sort.Slice(forwards, func(i, j int) bool {
+		return forwards[i].labels < forwards[j].labels
+	})
+
+	for _, description := range metricsDescriptions {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", description.name, description.help, description.name, description.metricType)
+		for _, metrics := range forwards {
+			fmt.Fprintf(w, "%s{%s} %d\n", description.name, metrics.labels, description.value(metrics))
+		}
+	}
+
+	name := "portforward_dial_duration_seconds"
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, "Time taken to connect to the remote", name)
+	for _, metrics := range forwards {
+		h := &metrics.dialDuration
+		h.lock.Lock()
+		for i, bound := range h.buckets {
+			var count int64
+			if h.counts != nil {
+				count = h.counts[i]
+			}
+			fmt.Fprintf(w, "%s_bucket{%s,le=\"%g\"} %d\n", name, metrics.labels, bound, count)
+		}
+		fmt.Fprintf(w, "%s_bucket{%s,le=\"+Inf\"} %d\n", name, metrics.labels, h.count)
+		fmt.Fprintf(w, "%s_sum{%s} %g\n", name, metrics.labels, h.sum)
+		fmt.Fprintf(w, "%s_count{%s} %d\n", name, metrics.labels, h.count)
+		h.lock.Unlock()
+	}
+}
+
+func (r *metricsRegistry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	r.writeMetrics(w)
+}
+
+// startMetricsServer serves the /metrics endpoint on the given address in background, until the context is cancelled
+func startMetricsServer(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", forwardsMetrics)
+	startHttpServer(ctx, "metrics", address, mux)
+}
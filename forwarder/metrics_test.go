@@ -0,0 +1,54 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMetricsTcpRelay(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	port := &PortForward{
+		Key:        "PORT_METRICS",
+		LocalPort:  getFreePort(t),
+		RemoteHost: "127.0.0.1",
+		RemotePort: remotePort,
+		Protocol:   ProtocolTCP,
+	}
+
+	startRelay(t, &tcpRelay{
+		port:   port,
+		dialer: newDialer(nil),
+	})
+	assertEcho(t, port.LocalPort, "hello")
+
+	var output strings.Builder
+	forwardsMetrics.writeMetrics(&output)
+	labels := fmt.Sprintf(`key="PORT_METRICS",protocol="tcp",local_host="",local_port="%d",remote_host="127.0.0.1",remote_port="%d"`, port.LocalPort, remotePort)
+
+	assert.Contains(t, output.String(), "# TYPE portforward_connections_total counter\n")
+	assert.Contains(t, output.String(), fmt.Sprintf("portforward_connections_total{%s} 1\n", labels))
+	assert.Contains(t, output.String(), fmt.Sprintf("portforward_received_bytes_total{%s} 6\n", labels))
+	assert.Contains(t, output.String(), fmt.Sprintf("portforward_sent_bytes_total{%s} 6\n", labels))
+	assert.Contains(t, output.String(), fmt.Sprintf("portforward_dial_errors_total{%s} 0\n", labels))
+	assert.Contains(t, output.String(), fmt.Sprintf("portforward_dial_duration_seconds_bucket{%s,le=\"+Inf\"} 1\n", labels))
+	assert.Contains(t, output.String(), fmt.Sprintf("portforward_dial_duration_seconds_count{%s} 1\n", labels))
+}
+
+func TestEscapeLabelValue(t *testing.T) {
+	assert.Equal(t, `a\"b\\c\nd`, escapeLabelValue("a\"b\\c\nd"))
+}
+
+func TestMetricsForPort(t *testing.T) {
+	registry := &metricsRegistry{forwards: make(map[string]*forwardMetrics)}
+	port := &PortForward{Key: "admin", LocalHost: "127.0.0.1", LocalPort: 8080, RemoteHost: "nginx", RemotePort: 80, Protocol: ProtocolTCP}
+	otherHostPort := *port
+	otherHostPort.LocalHost = "10.0.0.1"
+
+	// Mappings on different local addresses get their own series
+	assert.Same(t, registry.forPort(port), registry.forPort(port))
+	assert.NotSame(t, registry.forPort(port), registry.forPort(&otherHostPort))
+	assert.Contains(t, registry.forPort(&otherHostPort).labels, `local_host="10.0.0.1"`)
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// NoProxyRule is an entry of the NO_PROXY env var, matching the remote hosts that are connected directly
+type NoProxyRule struct {
+	Any            bool       // "*", matching all the hosts
+	Network        *net.IPNet // IP address or CIDR
+	Domain         string     // domain name, matching the domain and its subdomains
+	SubdomainsOnly bool       // ".example.com" or "*.example.com"
+	Port           int64      // 0 for any port
+}
+
+// parseNoProxy parses the NO_PROXY env var value: a list of IP addresses, CIDRs, domain names
+// (optionally with a leading "." or "*." for matching only the subdomains), or "*" for matching all, separated by commas.
+// Entries can include a port, for matching only that remote port.
+func parseNoProxy(value string) (rules []*NoProxyRule, err error) {
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.ToLower(strings.TrimSpace(entry))
+		if entry == "" {
+			continue
+		}
+
+		rule, err := parseNoProxyRule(entry)
+		if err != nil {
+			return nil, fmt.Errorf("invalid entry \"%s\": %s", entry, err)
+		}
+		rules = append(rules, rule)
+	}
+	return
+}
+
+func parseNoProxyRule(entry string) (*NoProxyRule, error) {
+	rule := &NoProxyRule{}
+	if entry == "*" {
+		rule.Any = true
+		return rule, nil
+	}
+
+	// CIDRs are parsed before splitting the port, as IPv6 CIDRs are not enclosed in brackets
+	if _, network, err := net.ParseCIDR(entry); err == nil {
+		rule.Network = network
+		return rule, nil
+	}
+
+	host := entry
+	if h, p, err := net.SplitHostPort(entry); err == nil {
+		port, err := strconv.ParseUint(p, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port: %s", err)
+		}
+		host, rule.Port = h, int64(port)
+	}
+
+	if ip := net.ParseIP(strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")); ip != nil {
+		bits := 8 * net.IPv6len
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 8*net.IPv4len
+		}
+		rule.Network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+		return rule, nil
+	}
+
+	if strings.HasPrefix(host, "*.") || strings.HasPrefix(host, ".") {
+		rule.SubdomainsOnly = true
+		host = strings.TrimPrefix(strings.TrimPrefix(host, "*"), ".")
+	}
+	if host == "" || strings.ContainsAny(host, "*/[]") {
+		return nil, fmt.Errorf("must be an IP address, CIDR, domain name or \"*\"")
+	}
+	rule.Domain = host
+	return rule, nil
+}
+
+func (r *NoProxyRule) matches(host string, port int64) bool {
+	if r.Port != 0 && r.Port != port {
+		return false
+	}
+	if r.Any {
+		return true
+	}
+
+	if r.Network != nil {
+		ip := net.ParseIP(host)
+		return ip != nil && r.Network.Contains(ip)
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+	if strings.HasSuffix(host, "."+r.Domain) {
+		return true
+	}
+	return !r.SubdomainsOnly && host == r.Domain
+}
+
+// noProxyMatches returns true if the remote host and port match any of the rules
+func noProxyMatches(rules []*NoProxyRule, host string, port int64) bool {
+	for _, rule := range rules {
+		if rule.matches(host, port) {
+			return true
+		}
+	}
+	return false
+}
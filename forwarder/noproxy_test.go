@@ -0,0 +1,30 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestNoProxyMatches(t *testing.T) {
+	rules, err := parseNoProxy("10.0.0.0/8, 192.168.1.10, [fd00::1]:5432, example.com, .internal, *.corp.net, db.local:5432, 2001:db8::/32")
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	for _, host := range []string{"10.1.2.3", "192.168.1.10", "example.com", "www.example.com", "db.internal", "git.corp.net", "2001:db8::10", "EXAMPLE.COM."} {
+		assert.True(t, noProxyMatches(rules, host, 80), host)
+	}
+	for _, host := range []string{"11.0.0.1", "192.168.1.11", "fd00::1", "notexample.com", "internal", "corp.net", "db.local", "2001:db9::1"} {
+		assert.False(t, noProxyMatches(rules, host, 80), host)
+	}
+	assert.True(t, noProxyMatches(rules, "fd00::1", 5432))
+	assert.True(t, noProxyMatches(rules, "db.local", 5432))
+
+	rules, err = parseNoProxy("*")
+	assert.Nil(t, err)
+	assert.True(t, noProxyMatches(rules, "anything", 80))
+
+	_, err = parseNoProxy("example.com, foo*bar")
+	assert.EqualError(t, err, "invalid entry \"foo*bar\": must be an IP address, CIDR, domain name or \"*\"")
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"os/exec"
+	"sync"
+	"syscall"
+)
+
+// childProcesses keeps track of the child processes started by the forwarders,
+// each one leading its own process group (along with the processes it forks)
+var childProcesses = &processRegistry{pgids: make(map[int]struct{})}
+
+type processRegistry struct {
+	pgids map[int]struct{}
+	lock  sync.Mutex
+}
+
+// start starts the command on its own process group, registering it.
+// The registry is locked meanwhile, so the reaper does not reap it before being registered.
+func (r *processRegistry) start(cmd *exec.Cmd) error {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	setProcessGroup(cmd)
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	r.pgids[cmd.Process.Pid] = struct{}{}
+	return nil
+}
+
+// remove unregisters the process group, once all its processes exited
+func (r *processRegistry) remove(pgid int) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	delete(r.pgids, pgid)
+}
+
+// isManaged returns whether the pid belongs to a registered process group leader,
+// which are waited by their forwarders. Must be called with the registry locked.
+func (r *processRegistry) isManaged(pid int) bool {
+	_, ok := r.pgids[pid]
+	return ok
+}
+
+// signalAll sends the signal to all the registered process groups
+func (r *processRegistry) signalAll(sig syscall.Signal) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for pgid := range r.pgids {
+		_ = signalProcessGroup(pgid, sig)
+	}
+}
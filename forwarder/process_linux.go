@@ -0,0 +1,28 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Signals passed on to the child processes (socat) as received
+var forwardedSignals = []os.Signal{syscall.SIGUSR1, syscall.SIGUSR2}
+
+// setProcessGroup makes the command run on its own process group, shared with all the processes it forks
+func setProcessGroup(cmd *exec.Cmd) {
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+}
+
+// signalProcessGroup sends the signal to all the processes on the group with the given id
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	return syscall.Kill(-pgid, sig)
+}
+
+// processGroupAlive returns whether any process remains on the group with the given id
+func processGroupAlive(pgid int) bool {
+	return syscall.Kill(-pgid, 0) == nil
+}
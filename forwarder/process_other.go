@@ -0,0 +1,24 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"syscall"
+)
+
+// Process groups are only managed on Linux, where the container runs
+
+var forwardedSignals []os.Signal
+
+func setProcessGroup(cmd *exec.Cmd) {}
+
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	return nil
+}
+
+func processGroupAlive(pgid int) bool {
+	return false
+}
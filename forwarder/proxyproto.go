@@ -0,0 +1,248 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ProxyProtocolV1 = 1
+	ProxyProtocolV2 = 2
+
+	// ProxyProtocolHeaderTimeout is the maximum time for clients to send the PROXY protocol header
+	ProxyProtocolHeaderTimeout = 10 * time.Second
+	// proxyProtocolV1MaxLength is the maximum length of PROXY protocol v1 headers, including the CRLF
+	proxyProtocolV1MaxLength = 107
+)
+
+// proxyProtocolV2Signature is the fixed prefix of the PROXY protocol v2 headers
+var proxyProtocolV2Signature = []byte("\r\n\r\n\x00\r\nQUIT\n")
+
+// proxyProtocolHeader returns the PROXY protocol header (v1 or v2) for a TCP connection from source to destination.
+// When the addresses are not TCP, or of different families, the header carries no addresses
+// (the receiver then uses the addresses of the connection itself).
+func proxyProtocolHeader(version int, source net.Addr, destination net.Addr) []byte {
+	src, srcOk := source.(*net.TCPAddr)
+	dst, dstOk := destination.(*net.TCPAddr)
+	known := srcOk && dstOk && (src.IP.To4() == nil) == (dst.IP.To4() == nil)
+	ipv4 := known && src.IP.To4() != nil
+
+	if version == ProxyProtocolV1 {
+		switch {
+		case !known:
+			return []byte("PROXY UNKNOWN\r\n")
+		case ipv4:
+			return []byte(fmt.Sprintf("PROXY TCP4 %s %s %d %d\r\n", src.IP.To4(), dst.IP.To4(), src.Port, dst.Port))
+		default:
+			return []byte(fmt.Sprintf("PROXY TCP6 %s %s %d %d\r\n", src.IP, dst.IP, src.Port, dst.Port))
+		}
+	}
+
+	var header bytes.Buffer
+	header.Write(proxyProtocolV2Signature)
+	header.WriteByte(0x21) // version 2, PROXY command
+
+	var addresses []byte
+	switch {
+	case !known:
+		header.WriteByte(0x00) // unspecified family and protocol
+	case ipv4:
+		header.WriteByte(0x11) // TCP over IPv4
+		addresses = append(append(addresses, src.IP.To4()...), dst.IP.To4()...)
+	default:
+		header.WriteByte(0x21) // TCP over IPv6
+		addresses = append(append(addresses, src.IP.To16()...), dst.IP.To16()...)
+	}
+	if known {
+		addresses = append(addresses, byte(src.Port>>8), byte(src.Port), byte(dst.Port>>8), byte(dst.Port))
+	}
+
+	_ = binary.Write(&header, binary.BigEndian, uint16(len(addresses)))
+	header.Write(addresses)
+	return header.Bytes()
+}
+
+// sendProxyProtocolHeader writes the PROXY protocol header on the connection to the remote,
+// with the addresses of the client connection; the remote connection is closed if failed
+func sendProxyProtocolHeader(remote net.Conn, version int, client net.Conn) (net.Conn, error) {
+	if _, err := remote.Write(proxyProtocolHeader(version, client.RemoteAddr(), client.LocalAddr())); err != nil {
+		_ = remote.Close()
+		return nil, fmt.Errorf("could not send PROXY protocol header: %s", err)
+	}
+	return remote, nil
+}
+
+// proxyProtocolConn is a client connection that started with a PROXY protocol header,
+// returning the addresses given on the header as the connection addresses
+type proxyProtocolConn struct {
+	net.Conn
+	reader     *bufio.Reader // with the data received after the header
+	remoteAddr net.Addr
+	localAddr  net.Addr
+}
+
+func (c *proxyProtocolConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
+
+func (c *proxyProtocolConn) RemoteAddr() net.Addr {
+	return c.remoteAddr
+}
+
+func (c *proxyProtocolConn) LocalAddr() net.Addr {
+	return c.localAddr
+}
+
+func (c *proxyProtocolConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return c.Conn.Close()
+}
+
+// acceptProxyProtocol reads the PROXY protocol header from a client connection,
+// returning the connection with the client and local addresses given on the header.
+// Fails if the connection does not come from a trusted network, or the header is missing or invalid.
+func acceptProxyProtocol(conn net.Conn, settings *AcceptProxyProtocol) (net.Conn, error) {
+	if !networksContain(settings.TrustedNetworks, conn.RemoteAddr()) {
+		return nil, fmt.Errorf("PROXY protocol header not accepted from untrusted source")
+	}
+
+	_ = conn.SetReadDeadline(time.Now().Add(ProxyProtocolHeaderTimeout))
+	reader := bufio.NewReader(conn)
+	source, destination, err := readProxyProtocolHeader(reader)
+	if err != nil {
+		return nil, fmt.Errorf("invalid PROXY protocol header: %s", err)
+	}
+	_ = conn.SetReadDeadline(noDeadline)
+
+	ppConn := &proxyProtocolConn{Conn: conn, reader: reader, remoteAddr: conn.RemoteAddr(), localAddr: conn.LocalAddr()}
+	if source != nil {
+		ppConn.remoteAddr, ppConn.localAddr = source, destination
+	}
+	return ppConn, nil
+}
+
+// networksContain returns true if the IP of the address is on any of the networks
+func networksContain(networks []*net.IPNet, addr net.Addr) bool {
+	tcpAddr, ok := addr.(*net.TCPAddr)
+	if !ok {
+		return false
+	}
+	for _, network := range networks {
+		if network.Contains(tcpAddr.IP) {
+			return true
+		}
+	}
+	return false
+}
+
+// readProxyProtocolHeader reads a PROXY protocol header (v1 or v2), returning the source and destination addresses on it.
+// Addresses are nil for headers not carrying them (LOCAL command, or UNKNOWN or non-TCP families).
+func readProxyProtocolHeader(reader *bufio.Reader) (source net.Addr, destination net.Addr, err error) {
+	// Both the v2 signature and the shortest v1 header have at least this length
+	prefix, err := reader.Peek(len(proxyProtocolV2Signature))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if bytes.Equal(prefix, proxyProtocolV2Signature) {
+		return readProxyProtocolV2Header(reader)
+	}
+	if bytes.HasPrefix(prefix, []byte("PROXY ")) {
+		return readProxyProtocolV1Header(reader)
+	}
+	return nil, nil, fmt.Errorf("missing header")
+}
+
+func readProxyProtocolV1Header(reader *bufio.Reader) (source net.Addr, destination net.Addr, err error) {
+	var line []byte
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) == proxyProtocolV1MaxLength {
+			return nil, nil, fmt.Errorf("v1 header too long")
+		}
+		b, err := reader.ReadByte()
+		if err != nil {
+			return nil, nil, err
+		}
+		line = append(line, b)
+	}
+
+	fields := strings.Split(strings.TrimSuffix(string(line), "\r\n"), " ")
+	if len(fields) >= 2 && fields[1] == "UNKNOWN" {
+		return nil, nil, nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		return nil, nil, fmt.Errorf("invalid v1 header \"%s\"", strings.TrimSpace(string(line)))
+	}
+
+	ipv4 := fields[1] == "TCP4"
+	parseAddr := func(ipField string, portField string) (*net.TCPAddr, error) {
+		ip := net.ParseIP(ipField)
+		if ip == nil || strings.Contains(ipField, ":") == ipv4 {
+			return nil, fmt.Errorf("invalid %s address \"%s\"", fields[1], ipField)
+		}
+		port, err := strconv.ParseUint(portField, 10, 16)
+		if err != nil {
+			return nil, fmt.Errorf("invalid port \"%s\"", portField)
+		}
+		return &net.TCPAddr{IP: ip, Port: int(port)}, nil
+	}
+
+	if source, err = parseAddr(fields[2], fields[4]); err != nil {
+		return nil, nil, err
+	}
+	if destination, err = parseAddr(fields[3], fields[5]); err != nil {
+		return nil, nil, err
+	}
+	return
+}
+
+func readProxyProtocolV2Header(reader *bufio.Reader) (source net.Addr, destination net.Addr, err error) {
+	header := make([]byte, len(proxyProtocolV2Signature)+4)
+	if _, err = io.ReadFull(reader, header); err != nil {
+		return nil, nil, err
+	}
+	versionCommand, family := header[12], header[13]
+	payload := make([]byte, binary.BigEndian.Uint16(header[14:]))
+	if _, err = io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+
+	if versionCommand>>4 != 2 {
+		return nil, nil, fmt.Errorf("unsupported version %d", versionCommand>>4)
+	}
+	switch versionCommand & 0x0f {
+	case 0x0: // LOCAL: the connection was made by the proxy itself (for example, health checks)
+		return nil, nil, nil
+	case 0x1: // PROXY
+	default:
+		return nil, nil, fmt.Errorf("unsupported command %d", versionCommand&0x0f)
+	}
+
+	// TLVs after the addresses are ignored
+	var ipLength int
+	switch family {
+	case 0x11: // TCP over IPv4
+		ipLength = net.IPv4len
+	case 0x21: // TCP over IPv6
+		ipLength = net.IPv6len
+	default:
+		return nil, nil, nil
+	}
+	if len(payload) < 2*ipLength+4 {
+		return nil, nil, fmt.Errorf("addresses too short")
+	}
+
+	ports := payload[2*ipLength:]
+	source = &net.TCPAddr{IP: net.IP(payload[:ipLength]), Port: int(binary.BigEndian.Uint16(ports))}
+	destination = &net.TCPAddr{IP: net.IP(payload[ipLength : 2*ipLength]), Port: int(binary.BigEndian.Uint16(ports[2:]))}
+	return
+}
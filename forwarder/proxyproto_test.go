@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestProxyProtocolHeader(t *testing.T) {
+	ipv4Source := &net.TCPAddr{IP: net.ParseIP("192.168.1.10"), Port: 54321}
+	ipv4Destination := &net.TCPAddr{IP: net.ParseIP("10.0.0.1"), Port: 443}
+	ipv6Source := &net.TCPAddr{IP: net.ParseIP("2001:db8::10"), Port: 54321}
+	ipv6Destination := &net.TCPAddr{IP: net.ParseIP("2001:db8::1"), Port: 443}
+
+	assert.Equal(t, "PROXY TCP4 192.168.1.10 10.0.0.1 54321 443\r\n", string(proxyProtocolHeader(ProxyProtocolV1, ipv4Source, ipv4Destination)))
+	assert.Equal(t, "PROXY TCP6 2001:db8::10 2001:db8::1 54321 443\r\n", string(proxyProtocolHeader(ProxyProtocolV1, ipv6Source, ipv6Destination)))
+	assert.Equal(t, "PROXY UNKNOWN\r\n", string(proxyProtocolHeader(ProxyProtocolV1, ipv4Source, ipv6Destination)))
+
+	assert.Equal(t, append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x0c"),
+		192, 168, 1, 10, 10, 0, 0, 1, 0xd4, 0x31, 0x01, 0xbb,
+	), proxyProtocolHeader(ProxyProtocolV2, ipv4Source, ipv4Destination))
+	assert.Equal(t, append([]byte("\r\n\r\n\x00\r\nQUIT\n\x21\x21\x00\x24"),
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x10,
+		0x20, 0x01, 0x0d, 0xb8, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0x01,
+		0xd4, 0x31, 0x01, 0xbb,
+	), proxyProtocolHeader(ProxyProtocolV2, ipv6Source, ipv6Destination))
+	assert.Equal(t, []byte("\r\n\r\n\x00\r\nQUIT\n\x21\x00\x00\x00"), proxyProtocolHeader(ProxyProtocolV2, ipv6Source, ipv4Destination))
+}
+
+// startProxyProtocolServer starts a remote reading the PROXY protocol v1 header line, then echoing the data.
+// The received headers are sent on the returned channel.
+func startProxyProtocolServer(t *testing.T) (int64, <-chan string) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	headers := make(chan string, 1)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				header, err := reader.ReadString('\n')
+				if err != nil {
+					return
+				}
+				headers <- header
+				_, _ = io.Copy(conn, reader)
+			}()
+		}
+	}()
+	return int64(listener.Addr().(*net.TCPAddr).Port), headers
+}
+
+func TestTcpRelaySendProxyProtocol(t *testing.T) {
+	remotePort, headers := startProxyProtocolServer(t)
+	localPort := getFreePort(t)
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:     localPort,
+			RemoteHost:    "127.0.0.1",
+			RemotePort:    remotePort,
+			ProxyProtocol: ProxyProtocolV1,
+		},
+		dialer: newDialer(nil),
+	})
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = fmt.Fprintf(conn, "hello\n")
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", reply)
+
+	clientAddr := conn.LocalAddr().(*net.TCPAddr)
+	assert.Equal(t, fmt.Sprintf("PROXY TCP4 127.0.0.1 127.0.0.1 %d %d\r\n", clientAddr.Port, localPort), <-headers)
+}
+
+func TestReadProxyProtocolHeader(t *testing.T) {
+	read := func(header string) (net.Addr, net.Addr, string, error) {
+		reader := bufio.NewReader(strings.NewReader(header + "data"))
+		source, destination, err := readProxyProtocolHeader(reader)
+		rest, _ := io.ReadAll(reader)
+		return source, destination, string(rest), err
+	}
+
+	for _, addresses := range [][2]*net.TCPAddr{
+		{{IP: net.ParseIP("192.168.1.10").To4(), Port: 54321}, {IP: net.ParseIP("10.0.0.1").To4(), Port: 443}},
+		{{IP: net.ParseIP("2001:db8::10"), Port: 54321}, {IP: net.ParseIP("2001:db8::1"), Port: 443}},
+	} {
+		for _, version := range []int{ProxyProtocolV1, ProxyProtocolV2} {
+			source, destination, rest, err := read(string(proxyProtocolHeader(version, addresses[0], addresses[1])))
+			assert.Nil(t, err)
+			assert.Equal(t, addresses[0].String(), fmt.Sprint(source))
+			assert.Equal(t, addresses[1].String(), fmt.Sprint(destination))
+			assert.Equal(t, "data", rest)
+		}
+	}
+
+	// Headers without addresses
+	for _, header := range []string{
+		"PROXY UNKNOWN\r\n",
+		"PROXY UNKNOWN 192.168.1.10 10.0.0.1 54321 443\r\n",
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x00\x00\x00",                              // LOCAL
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x31\x00\x03abc",                           // unix socket
+		"\r\n\r\n\x00\r\nQUIT\n\x20\x11\x00\x0c" + strings.Repeat("\x01", 12), // LOCAL with addresses
+	} {
+		source, destination, rest, err := read(header)
+		assert.Nil(t, err, header)
+		assert.Nil(t, source, header)
+		assert.Nil(t, destination, header)
+		assert.Equal(t, "data", rest, header)
+	}
+
+	for header, expectedErr := range map[string]string{
+		"GET / HTTP/1.1\r\n":                                     "missing header",
+		"PROXY TCP4 192.168.1.10 10.0.0.1 54321\r\n":             "invalid v1 header \"PROXY TCP4 192.168.1.10 10.0.0.1 54321\"",
+		"PROXY TCP4 2001:db8::10 10.0.0.1 54321 443\r\n":         "invalid TCP4 address \"2001:db8::10\"",
+		"PROXY TCP4 192.168.1.10 10.0.0.1 54321 65536\r\n":       "invalid port \"65536\"",
+		"PROXY TCP4 " + strings.Repeat("1", 100) + "\r\n":        "v1 header too long",
+		"\r\n\r\n\x00\r\nQUIT\n\x11\x11\x00\x00":                 "unsupported version 1",
+		"\r\n\r\n\x00\r\nQUIT\n\x22\x11\x00\x00":                 "unsupported command 2",
+		"\r\n\r\n\x00\r\nQUIT\n\x21\x11\x00\x04\x01\x02\x03\x04": "addresses too short",
+	} {
+		_, _, _, err := read(header)
+		assert.EqualError(t, err, expectedErr, header)
+	}
+}
+
+func TestTcpRelayAcceptProxyProtocol(t *testing.T) {
+	remotePort, headers := startProxyProtocolServer(t)
+	trustedPort := getFreePort(t)
+	untrustedPort := getFreePort(t)
+	relay := func(localPort int64, trusted string) *tcpRelay {
+		network, _ := parseNetwork(trusted)
+		return &tcpRelay{
+			port: &PortForward{
+				LocalPort:           localPort,
+				RemoteHost:          "127.0.0.1",
+				RemotePort:          remotePort,
+				ProxyProtocol:       ProxyProtocolV1,
+				AcceptProxyProtocol: &AcceptProxyProtocol{TrustedNetworks: []*net.IPNet{network}},
+			},
+			dialer:  newDialer(nil),
+			metrics: &forwardMetrics{}, // read by the test while serving
+		}
+	}
+	startRelay(t, relay(trustedPort, "127.0.0.0/8"))
+	untrustedRelay := relay(untrustedPort, "10.0.0.0/8")
+	startRelay(t, untrustedRelay)
+
+	// The client address received on the header is passed on to the remote
+	header := proxyProtocolHeader(ProxyProtocolV2,
+		&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000},
+		&net.TCPAddr{IP: net.ParseIP("198.51.100.1"), Port: 443},
+	)
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", trustedPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write(append(header, "hello\n"...))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "hello\n", reply)
+	assert.Equal(t, "PROXY TCP4 203.0.113.7 198.51.100.1 40000 443\r\n", <-headers)
+
+	// Connections from untrusted sources are rejected
+	conn, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", untrustedPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_, _ = conn.Write(append(header, "hello\n"...))
+	_, err = bufio.NewReader(conn).ReadString('\n')
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(1), atomic.LoadInt64(&untrustedRelay.metrics.proxyProtocolErrors))
+}
@@ -0,0 +1,98 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	ReaperInterval         = 5 * time.Second
+	prctlSetChildSubreaper = 36 // PR_SET_CHILD_SUBREAPER
+)
+
+// startReaper reaps, in background, the zombie processes that are children of the current process.
+// Running as PID 1 in the container, these are the orphaned processes (like the connection handlers forked by socat).
+// When not running as PID 1, the current process becomes a subreaper, so orphaned descendants are reparented to it.
+func startReaper() {
+	if os.Getpid() != 1 {
+		_, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prctlSetChildSubreaper, 1, 0)
+		if errno != 0 {
+			fmt.Printf("Could not become child subreaper: %s\n", errno.Error())
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGCHLD)
+	ticker := time.NewTicker(ReaperInterval)
+
+	go func() {
+		for {
+			select {
+			case <-signals:
+			case <-ticker.C:
+			}
+			reapZombies()
+		}
+	}()
+}
+
+// reapZombies waits for the zombie children of the current process, except the managed ones
+// (socat processes being waited by their forwarders)
+func reapZombies() {
+	childProcesses.lock.Lock()
+	defer childProcesses.lock.Unlock()
+
+	selfPid := os.Getpid()
+	entries, err := os.ReadDir("/proc")
+	if err != nil {
+		return
+	}
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil || childProcesses.isManaged(pid) {
+			continue
+		}
+
+		state, parentPid, ok := readProcessStat(pid)
+		if !ok || parentPid != selfPid || state != "Z" {
+			continue
+		}
+
+		var status syscall.WaitStatus
+		_, _ = syscall.Wait4(pid, &status, syscall.WNOHANG, nil)
+	}
+}
+
+// readProcessStat returns the state and parent pid of a process, from /proc/<pid>/stat
+func readProcessStat(pid int) (state string, parentPid int, ok bool) {
+	data, err := os.ReadFile(fmt.Sprintf("/proc/%d/stat", pid))
+	if err != nil {
+		return
+	}
+
+	// Format: "pid (comm) state ppid ..."; comm may contain spaces or parenthesis
+	i := bytes.LastIndexByte(data, ')')
+	if i < 0 {
+		return
+	}
+	fields := strings.Fields(string(data[i+1:]))
+	if len(fields) < 2 {
+		return
+	}
+
+	parentPid, err = strconv.Atoi(fields[1])
+	if err != nil {
+		return
+	}
+	return fields[0], parentPid, true
+}
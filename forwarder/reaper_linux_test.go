@@ -0,0 +1,39 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestReapZombies(t *testing.T) {
+	// Started but not waited processes become zombies when exiting
+	managed := exec.Command("true")
+	assert.Nil(t, childProcesses.start(managed))
+	defer childProcesses.remove(managed.Process.Pid)
+
+	unmanaged := exec.Command("true")
+	assert.Nil(t, unmanaged.Start())
+	time.Sleep(100 * time.Millisecond)
+
+	state, parentPid, ok := readProcessStat(unmanaged.Process.Pid)
+	assert.True(t, ok)
+	assert.Equal(t, "Z", state)
+	assert.Equal(t, os.Getpid(), parentPid)
+
+	reapZombies()
+
+	// The unmanaged process was reaped, the managed one is left for its owner
+	_, _, ok = readProcessStat(unmanaged.Process.Pid)
+	assert.False(t, ok)
+	state, _, ok = readProcessStat(managed.Process.Pid)
+	assert.True(t, ok)
+	assert.Equal(t, "Z", state)
+	assert.Nil(t, managed.Wait())
+}
@@ -0,0 +1,7 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// Zombie processes are only reaped on Linux, where the container runs
+func startReaper() {}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	DialTimeout          = 10 * time.Second
+	AcceptRetryThinktime = 100 * time.Millisecond
+)
+
+// ErrDrainTimeout is returned by forwarders when, being stopped, their connections did not finish in time
+var ErrDrainTimeout = fmt.Errorf("connections did not finish within the drain timeout, were closed")
+
+// tcpRelay forwards a single TCP port mapping from within the current process,
+// accepting connections on the local port and copying data to/from the remote
+type tcpRelay struct {
+	port         *PortForward
+	dialer       Dialer
+	access       []*AccessRule
+	drainTimeout time.Duration // accessed atomically
+	listenTLS    *tls.Config
+	targetTLS    *tls.Config
+	limiter      *connLimiter
+	bandwidth    *bandwidthLimiter
+	conns        connTracker
+	metrics      *forwardMetrics
+}
+
+// connTracker keeps track of the active connections of a relay, for draining them on shutdown
+type connTracker struct {
+	waitGroup sync.WaitGroup
+	conns     map[io.Closer]struct{}
+	lock      sync.Mutex
+}
+
+func (t *connTracker) add(conn io.Closer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if t.conns == nil {
+		t.conns = make(map[io.Closer]struct{})
+	}
+	t.conns[conn] = struct{}{}
+}
+
+func (t *connTracker) remove(conn io.Closer) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+	delete(t.conns, conn)
+}
+
+// drain waits for the active connections to finish, closing them if not done within the timeout.
+// Returns false if connections had to be closed.
+func (t *connTracker) drain(timeout time.Duration) bool {
+	done := make(chan struct{})
+	go func() {
+		t.waitGroup.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return true
+	case <-time.After(timeout):
+	}
+
+	t.lock.Lock()
+	for conn := range t.conns {
+		_ = conn.Close()
+	}
+	t.lock.Unlock()
+
+	<-done
+	return false
+}
+
+func (r *tcpRelay) Serve(ctx context.Context) error {
+	if r.metrics == nil {
+		r.metrics = forwardsMetrics.forPort(r.port)
+	}
+
+	if r.port.Limits != nil && r.limiter == nil {
+		r.limiter = newConnLimiter(r.port.Limits)
+	}
+	if r.bandwidth == nil {
+		r.bandwidth = newBandwidthLimiter(r.port.Bandwidth)
+	}
+
+	if r.port.TargetTLS != nil {
+		var err error
+		if r.targetTLS, err = newTargetTLSConfig(r.port); err != nil {
+			return err
+		}
+	}
+
+	// Kept when serving again after failing, along with the certificate files watcher
+	if r.port.ListenTLS != nil && r.listenTLS == nil {
+		var err error
+		if r.listenTLS, err = newListenerTLSConfig(ctx, r.port.ListenTLS); err != nil {
+			return err
+		}
+	}
+
+	listener, err := net.Listen("tcp", r.port.listenAddress())
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+
+	var acceptErr error
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				break
+			}
+			// Temporary errors (like running out of file descriptors) are retried, as net/http does
+			if netErr, ok := err.(net.Error); ok && (netErr.Timeout() || netErr.Temporary()) {
+				fmt.Printf("Port forward %s could not accept connection (retrying): %s\n", r.port.ToString(), err)
+				time.Sleep(AcceptRetryThinktime)
+				continue
+			}
+			acceptErr = err
+			break
+		}
+
+		r.conns.waitGroup.Add(1)
+		go r.handle(ctx, conn)
+	}
+
+	// Stopped accepting new connections; let the active ones finish (also when failing, before serving again)
+	_ = listener.Close()
+	drained := r.conns.drain(time.Duration(atomic.LoadInt64((*int64)(&r.drainTimeout))))
+	if acceptErr != nil {
+		return acceptErr
+	}
+	if !drained {
+		return ErrDrainTimeout
+	}
+	return nil
+}
+
+func (r *tcpRelay) handle(ctx context.Context, client net.Conn) {
+	defer r.conns.waitGroup.Done()
+	r.conns.add(client)
+	defer r.conns.remove(client)
+	defer func() { _ = client.Close() }()
+	defer r.metrics.connectionStarted()()
+
+	// The PROXY protocol header comes before the TLS handshake, replacing the client address
+	if r.port.AcceptProxyProtocol != nil {
+		ppClient, err := acceptProxyProtocol(client, r.port.AcceptProxyProtocol)
+		if err != nil {
+			atomic.AddInt64(&r.metrics.proxyProtocolErrors, 1)
+			fmt.Printf("Port forward %s rejected connection from %s: %s\n", r.port.ToString(), client.RemoteAddr(), err)
+			return
+		}
+		client = ppClient
+	}
+
+	if !accessAllowed(r.access, client.RemoteAddr()) {
+		atomic.AddInt64(&r.metrics.deniedConnections, 1)
+		fmt.Printf("Port forward %s denied connection from %s\n", r.port.ToString(), client.RemoteAddr())
+		return
+	}
+
+	if r.limiter != nil {
+		release, err := r.limiter.acquire(ctx, clientIp(client.RemoteAddr()), func(reason error) {
+			atomic.AddInt64(&r.metrics.queuedConnections, 1)
+			fmt.Printf("Port forward %s queued connection from %s: %s\n", r.port.ToString(), client.RemoteAddr(), reason)
+		})
+		if err != nil {
+			atomic.AddInt64(&r.metrics.limitedConnections, 1)
+			fmt.Printf("Port forward %s rejected connection from %s: %s\n", r.port.ToString(), client.RemoteAddr(), err)
+			return
+		}
+		defer release()
+	}
+
+	// Complete the TLS handshake before connecting to the remote
+	if r.listenTLS != nil {
+		tlsClient := tls.Server(client, r.listenTLS)
+		client = tlsClient
+		handshakeCtx, cancel := context.WithTimeout(ctx, TLSHandshakeTimeout)
+		err := tlsClient.HandshakeContext(handshakeCtx)
+		cancel()
+		if err != nil {
+			atomic.AddInt64(&r.metrics.tlsHandshakeErrors, 1)
+			fmt.Printf("Port forward %s TLS handshake with %s failed: %s\n", r.port.ToString(), client.RemoteAddr(), err)
+			return
+		}
+	}
+
+	remoteAddress := net.JoinHostPort(r.port.RemoteHost, fmt.Sprintf("%d", r.port.RemotePort))
+	dialCtx, cancel := context.WithTimeout(ctx, DialTimeout)
+	dialStart := time.Now()
+	remote, err := r.dialer.DialContext(dialCtx, "tcp", remoteAddress)
+	if err == nil && r.port.ProxyProtocol != 0 {
+		// Sent before the TLS handshake, as received by the remote
+		remote, err = sendProxyProtocolHeader(remote, r.port.ProxyProtocol, client)
+	}
+	if err == nil && r.targetTLS != nil {
+		remote, err = tlsHandshakeRemote(dialCtx, remote, r.targetTLS)
+	}
+	cancel()
+	r.metrics.observeDial(dialStart, err)
+	if err != nil {
+		fmt.Printf("Port forward %s could not reach remote: %s\n", r.port.ToString(), err)
+		return
+	}
+	defer remote.Close()
+
+	r.conns.add(remote)
+	defer r.conns.remove(remote)
+
+	// Closed along with the connections when draining, for interrupting the writes waiting for the bandwidth limits
+	toRemote, toClient, throttle := r.bandwidth.connection(client, remote)
+	defer throttle.Close()
+	r.conns.add(throttle)
+	defer r.conns.remove(throttle)
+	pipe(client, remote, toRemote, toClient, &r.metrics.bytesIn, &r.metrics.bytesOut)
+}
+
+// updateBandwidth applies new bandwidth limits to the relay, including its active connections
+func (r *tcpRelay) updateBandwidth(limits *BandwidthLimits) {
+	r.bandwidth.update(limits)
+}
+
+// updateDrainTimeout changes the time given to the active connections to finish when the relay is stopped
+func (r *tcpRelay) updateDrainTimeout(timeout time.Duration) {
+	atomic.StoreInt64((*int64)(&r.drainTimeout), int64(timeout))
+}
+
+// closeWriter is implemented by connections supporting half-close (like *net.TCPConn)
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// countingWriter adds the bytes written through it to a counter, atomically
+type countingWriter struct {
+	writer  io.Writer
+	counter *int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.writer.Write(p)
+	atomic.AddInt64(w.counter, int64(n))
+	return n, err
+}
+
+// pipe copies data in both directions between the given connections until both sides are done,
+// writing through the given writers of the remote and the client (the connections, or wrapping them),
+// and adding the bytes sent from client to remote, and received from remote to client, to the given counters as copied.
+// Returns the totals of the connection.
+func pipe(client net.Conn, remote net.Conn, toRemote io.Writer, toClient io.Writer, sentCounter *int64, receivedCounter *int64) (sent int64, received int64) {
+	var waitGroup sync.WaitGroup
+	waitGroup.Add(2)
+
+	copyHalf := func(dst net.Conn, dstWriter io.Writer, src net.Conn, counter *int64, written *int64) {
+		defer waitGroup.Done()
+		*written, _ = io.Copy(&countingWriter{writer: dstWriter, counter: counter}, src)
+
+		// Propagate the EOF to the other side, or close it if half-close is not supported
+		if cw, ok := dst.(closeWriter); ok {
+			_ = cw.CloseWrite()
+		} else {
+			_ = dst.Close()
+		}
+	}
+
+	go copyHalf(remote, toRemote, client, sentCounter, &sent)
+	go copyHalf(client, toClient, remote, receivedCounter, &received)
+	waitGroup.Wait()
+	return
+}
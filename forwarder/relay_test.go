@@ -0,0 +1,551 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const RelayTestThinktime = 100 * time.Millisecond
+
+// startEchoServer starts a TCP server on the given host, replying back everything received, returning its port
+func startEchoServer(t *testing.T, host string) int64 {
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return int64(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// getFreePort returns a local TCP port that is currently available
+func getFreePort(t *testing.T) int64 {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	return int64(listener.Addr().(*net.TCPAddr).Port)
+}
+
+// startRelay serves the given forwarder in background, stopping it when the test finishes
+func startRelay(t *testing.T, forwarder Forwarder) {
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	go func() {
+		_ = forwarder.Serve(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+}
+
+func assertEcho(t *testing.T, port int64, message string) {
+	assertEchoOn(t, "127.0.0.1", port, message)
+}
+
+func assertEchoOn(t *testing.T, host string, port int64, message string) {
+	conn, err := net.Dial("tcp", net.JoinHostPort(host, fmt.Sprintf("%d", port)))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\n", message)
+	assert.Nil(t, err)
+
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, message+"\n", reply)
+}
+
+func TestTcpRelay(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(nil),
+	})
+
+	assertEcho(t, localPort, "hello")
+	assertEcho(t, localPort, "world")
+}
+
+func TestTcpRelayIpv6(t *testing.T) {
+	if !ipv6Supported() {
+		t.Skip("IPv6 not supported")
+	}
+
+	remotePort := startEchoServer(t, "::1")
+	localPort := getFreePort(t)
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "::1",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(nil),
+	})
+
+	assertEchoOn(t, "::1", localPort, "hello v6")
+	assertEchoOn(t, "127.0.0.1", localPort, "hello v4")
+}
+
+func TestTcpRelayLocalHost(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalHost:  "127.0.0.1",
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(nil),
+	})
+
+	assertEcho(t, localPort, "hello")
+	_, err := net.Dial("tcp", fmt.Sprintf("127.0.0.2:%d", localPort))
+	assert.NotNil(t, err)
+}
+
+func TestTcpRelaySocks4a(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+
+	// Minimal SOCKS4A proxy, connecting to the echo server whatever the requested host is
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+	requestedHosts := make(chan string, 1)
+
+	go func() {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		header := make([]byte, 8)
+		_, _ = io.ReadFull(reader, header)
+		_, _ = reader.ReadString(0) // user id
+		host, _ := reader.ReadString(0)
+		requestedHosts <- host[:len(host)-1]
+
+		remote, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{0, socks4ReplyGranted, 0, 0, 0, 0, 0, 0})
+		go func() { _, _ = io.Copy(remote, reader) }()
+		_, _ = io.Copy(conn, remote)
+	}()
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "echo.internal",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(&Proxy{
+			Scheme: ProxySchemeSocks4a,
+			Host:   "127.0.0.1",
+			Port:   proxyListener.Addr().(*net.TCPAddr).Port,
+		}),
+	})
+
+	assertEcho(t, localPort, "through the proxy")
+	assert.Equal(t, "echo.internal", <-requestedHosts)
+}
+
+func TestTcpRelaySocks5(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+
+	// Minimal SOCKS5 proxy with username/password authentication, connecting to the echo server
+	// whatever the requested host is
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+	requests := make(chan string, 1)
+
+	go func() {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		greeting := make([]byte, 3)
+		_, _ = io.ReadFull(reader, greeting)
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthUserPass})
+
+		readField := func() string {
+			length, _ := reader.ReadByte()
+			field := make([]byte, length)
+			_, _ = io.ReadFull(reader, field)
+			return string(field)
+		}
+		_, _ = reader.ReadByte() // auth version
+		username, password := readField(), readField()
+		_, _ = conn.Write([]byte{socks5UserPassVersion, socks5ReplySucceeded})
+
+		header := make([]byte, 4)
+		_, _ = io.ReadFull(reader, header)
+		host := readField()
+		_, _ = io.ReadFull(reader, make([]byte, 2))
+		requests <- fmt.Sprintf("%s:%s@%s", username, password, host)
+
+		remote, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0, socks5AddressIpv4, 0, 0, 0, 0, 0, 0})
+		go func() { _, _ = io.Copy(remote, reader) }()
+		_, _ = io.Copy(conn, remote)
+	}()
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "echo.internal",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(&Proxy{
+			Scheme:   ProxySchemeSocks5,
+			Host:     "127.0.0.1",
+			Port:     proxyListener.Addr().(*net.TCPAddr).Port,
+			Username: "user",
+			Password: "secret",
+		}),
+	})
+
+	assertEcho(t, localPort, "through the proxy")
+	assert.Equal(t, "user:secret@echo.internal", <-requests)
+}
+
+func TestSocks5HandshakeRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		_, _ = io.ReadFull(server, make([]byte, 3))
+		_, _ = server.Write([]byte{socks5Version, socks5AuthNone})
+		_, _ = io.ReadFull(server, make([]byte, 10))
+		_, _ = server.Write([]byte{socks5Version, 0x05, 0, socks5AddressIpv4})
+	}()
+
+	err := socks5Handshake(client, "", "", "10.0.0.1", 80)
+	assert.EqualError(t, err, "request rejected by proxy: connection refused (code 5)")
+}
+
+func TestTcpRelayHttpConnect(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+
+	// Minimal HTTP CONNECT proxy, connecting to the echo server whatever the requested target is
+	proxyListener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer proxyListener.Close()
+	requests := make(chan *http.Request, 1)
+
+	go func() {
+		conn, err := proxyListener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		reader := bufio.NewReader(conn)
+		request, err := http.ReadRequest(reader)
+		if err != nil {
+			return
+		}
+		requests <- request
+
+		remote, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+		if err != nil {
+			return
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		go func() { _, _ = io.Copy(remote, reader) }()
+		_, _ = io.Copy(conn, remote)
+	}()
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "echo.internal",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(&Proxy{
+			Scheme:   ProxySchemeHttp,
+			Host:     "127.0.0.1",
+			Port:     proxyListener.Addr().(*net.TCPAddr).Port,
+			Username: "user",
+			Password: "secret",
+		}),
+	})
+
+	assertEcho(t, localPort, "through the proxy")
+	request := <-requests
+	assert.Equal(t, http.MethodConnect, request.Method)
+	assert.Equal(t, fmt.Sprintf("echo.internal:%d", remotePort), request.Host)
+	assert.Equal(t, "Basic dXNlcjpzZWNyZXQ=", request.Header.Get("Proxy-Authorization"))
+}
+
+func TestHttpConnectHandshakeRejected(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+
+	go func() {
+		defer server.Close()
+		_, _ = http.ReadRequest(bufio.NewReader(server))
+		_, _ = io.WriteString(server, "HTTP/1.1 407 Proxy Authentication Required\r\nContent-Length: 0\r\n\r\n")
+	}()
+
+	err := httpConnectHandshake(client, "", "", "10.0.0.1", 80)
+	assert.EqualError(t, err, "request rejected by proxy: 407 Proxy Authentication Required")
+}
+
+// startTestProxy starts a proxy server, relaying each connection to the target returned by the handshake
+// (or closing it if the handshake returns an empty target), returning its port
+func startTestProxy(t *testing.T, handshake func(conn net.Conn, reader *bufio.Reader) string) int {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				reader := bufio.NewReader(conn)
+				target := handshake(conn, reader)
+				if target == "" {
+					return
+				}
+				remote, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer remote.Close()
+				go func() { _, _ = io.Copy(remote, reader) }()
+				_, _ = io.Copy(conn, remote)
+			}()
+		}
+	}()
+
+	return listener.Addr().(*net.TCPAddr).Port
+}
+
+func TestTcpRelayProxyChain(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+
+	// Hop 2: HTTP CONNECT proxy, connecting to the echo server
+	httpProxyPort := startTestProxy(t, func(conn net.Conn, reader *bufio.Reader) string {
+		if _, err := http.ReadRequest(reader); err != nil {
+			return ""
+		}
+		_, _ = io.WriteString(conn, "HTTP/1.1 200 Connection established\r\n\r\n")
+		return fmt.Sprintf("127.0.0.1:%d", remotePort)
+	})
+
+	// Hop 1: SOCKS5 proxy without authentication, connecting to the requested (IPv4) address
+	socksProxyPort := startTestProxy(t, func(conn net.Conn, reader *bufio.Reader) string {
+		_, _ = io.ReadFull(reader, make([]byte, 3))
+		_, _ = conn.Write([]byte{socks5Version, socks5AuthNone})
+		request := make([]byte, 10)
+		if _, err := io.ReadFull(reader, request); err != nil || request[3] != socks5AddressIpv4 {
+			return ""
+		}
+		_, _ = conn.Write([]byte{socks5Version, socks5ReplySucceeded, 0, socks5AddressIpv4, 0, 0, 0, 0, 0, 0})
+		return fmt.Sprintf("%s:%d", net.IP(request[4:8]), binary.BigEndian.Uint16(request[8:]))
+	})
+
+	chain := &Proxy{
+		Scheme: ProxySchemeSocks5,
+		Host:   "127.0.0.1",
+		Port:   socksProxyPort,
+		Next: &Proxy{
+			Scheme: ProxySchemeHttp,
+			Host:   "127.0.0.1",
+			Port:   httpProxyPort,
+		},
+	}
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "echo.internal",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(chain),
+	})
+	assertEcho(t, localPort, "through the proxy chain")
+
+	// Errors name the hop that failed
+	rejectingProxyPort := startTestProxy(t, func(conn net.Conn, reader *bufio.Reader) string {
+		_, _ = http.ReadRequest(reader)
+		_, _ = io.WriteString(conn, "HTTP/1.1 407 Proxy Authentication Required\r\n\r\n")
+		return ""
+	})
+	chain.Next.Port = rejectingProxyPort
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	_, err := newDialer(chain).DialContext(ctx, "tcp", "echo.internal:80")
+	assert.EqualError(t, err, fmt.Sprintf("handshake with hop 2 (http proxy 127.0.0.1:%d) failed: request rejected by proxy: 407 Proxy Authentication Required", rejectingProxyPort))
+
+	chain.Port = int(getFreePort(t))
+	_, err = newDialer(chain).DialContext(ctx, "tcp", "echo.internal:80")
+	assert.Contains(t, fmt.Sprint(err), fmt.Sprintf("could not connect to hop 1 (socks5 proxy 127.0.0.1:%d)", chain.Port))
+}
+
+func TestUdpRelay(t *testing.T) {
+	remote, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer remote.Close()
+
+	// UDP echo server
+	go func() {
+		buffer := make([]byte, UdpMaxDatagramSize)
+		for {
+			n, addr, err := remote.ReadFrom(buffer)
+			if err != nil {
+				return
+			}
+			_, _ = remote.WriteTo(buffer[:n], addr)
+		}
+	}()
+
+	localPort := getFreePort(t)
+	relay := &udpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: int64(remote.LocalAddr().(*net.UDPAddr).Port),
+			Protocol:   ProtocolUDP,
+		},
+		idleTimeout: RelayTestThinktime,
+	}
+	startRelay(t, relay)
+
+	for _, message := range []string{"ping", "pong"} {
+		conn, err := net.Dial("udp", fmt.Sprintf("127.0.0.1:%d", localPort))
+		if !assert.Nil(t, err) {
+			return
+		}
+
+		_, err = conn.Write([]byte(message))
+		assert.Nil(t, err)
+
+		buffer := make([]byte, 64)
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		n, err := conn.Read(buffer)
+		assert.Nil(t, err)
+		assert.Equal(t, message, string(buffer[:n]))
+		_ = conn.Close()
+	}
+
+	// Sessions are closed after the idle timeout
+	time.Sleep(3 * RelayTestThinktime)
+	relay.lock.Lock()
+	assert.Empty(t, relay.sessions)
+	relay.lock.Unlock()
+}
+
+func TestTcpRelayDrain(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+	relay := &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+		},
+		dialer:       newDialer(nil),
+		drainTimeout: 3 * RelayTestThinktime,
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	result := make(chan error, 1)
+	go func() {
+		result <- relay.Serve(ctx)
+	}()
+	time.Sleep(RelayTestThinktime)
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	_ = conn.SetDeadline(time.Now().Add(time.Second))
+
+	_, _ = fmt.Fprintln(conn, "before")
+	reply, err := reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "before\n", reply)
+
+	// Stopped relay: new connections are refused, active ones keep working until the drain timeout
+	cancel()
+	time.Sleep(RelayTestThinktime)
+
+	_, err = net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	assert.NotNil(t, err)
+
+	_, _ = fmt.Fprintln(conn, "draining")
+	reply, err = reader.ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, "draining\n", reply)
+
+	assert.Equal(t, ErrDrainTimeout, <-result)
+	_, err = reader.ReadString('\n')
+	assert.NotNil(t, err)
+}
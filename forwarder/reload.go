@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const ConfigWatchInterval = 2 * time.Second
+
+// watchReloads reloads the settings on the manager when receiving SIGHUP, or when the config file changes
+func watchReloads(ctx context.Context, manager *Manager, configFile string) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	var configChanges <-chan struct{}
+	if configFile != "" {
+		configChanges = watchFile(ctx, configFile, ConfigWatchInterval)
+	}
+
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				signal.Stop(signals)
+				return
+			case <-signals:
+				fmt.Println("Received SIGHUP, reloading settings ...")
+			case <-configChanges:
+				fmt.Printf("Config file %s changed, reloading settings ...\n", configFile)
+			}
+			reloadSettings(manager, configFile)
+		}
+	}()
+}
+
+func reloadSettings(manager *Manager, configFile string) {
+	settings, errors := LoadSettings(configFile)
+	if errors != nil {
+		fmt.Println("Errors in settings, keeping the current ones:")
+		for _, err := range errors {
+			fmt.Println(err.Error())
+		}
+		return
+	}
+
+	if errors = manager.Reload(settings); errors != nil {
+		fmt.Println("Errors in settings (conflicting with the port mappings added at runtime), keeping the current ones:")
+		for _, err := range errors {
+			fmt.Println(err.Error())
+		}
+	}
+}
+
+// watchFile polls the file on the given path, notifying on the returned channel when its modification time or size change
+func watchFile(ctx context.Context, path string, interval time.Duration) <-chan struct{} {
+	changes := make(chan struct{}, 1)
+	lastStat, _ := os.Stat(path)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+
+			stat, err := os.Stat(path)
+			if err != nil || (lastStat != nil && stat.ModTime().Equal(lastStat.ModTime()) && stat.Size() == lastStat.Size()) {
+				continue
+			}
+
+			lastStat = stat
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+
+	return changes
+}
@@ -0,0 +1,199 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// socatForwarder forwards a single port mapping by running a socat process
+type socatForwarder struct {
+	port           *PortForward
+	proxy          *Proxy
+	udpIdleTimeout time.Duration
+	dualStack      bool
+	drainTimeout   time.Duration // accessed atomically
+}
+
+const ProcessGroupPollInterval = 100 * time.Millisecond
+
+var (
+	ipv6SupportedOnce sync.Once
+	ipv6SupportedFlag bool
+)
+
+// ipv6Supported returns whether IPv6 sockets can be opened on the system
+// (it may be disabled on containers, in which case socat can only listen on IPv4)
+func ipv6Supported() bool {
+	ipv6SupportedOnce.Do(func() {
+		listener, err := net.Listen("tcp6", "[::1]:0")
+		if err == nil {
+			ipv6SupportedFlag = true
+			_ = listener.Close()
+		}
+	})
+	return ipv6SupportedFlag
+}
+
+// getListenChunk returns the socat address for listening on the local port.
+// When dualStack is true, a single IPv6 socket accepting both IPv4 and IPv6 clients is used,
+// unless listening on a specific address.
+func getListenChunk(port *PortForward, dualStack bool) string {
+	addressType := "TCP-LISTEN"
+	options := "fork"
+	if port.Protocol == ProtocolUDP {
+		addressType = "UDP-LISTEN"
+		options = "fork,reuseaddr"
+	}
+
+	if port.LocalHost != "" {
+		// TCP4-LISTEN:8080,fork,bind=127.0.0.1 / TCP6-LISTEN:8080,fork,bind=[::1]
+		if net.ParseIP(port.LocalHost).To4() != nil {
+			addressType = strings.Replace(addressType, "-", "4-", 1)
+		} else {
+			addressType = strings.Replace(addressType, "-", "6-", 1)
+		}
+		options += ",bind=" + formatHost(port.LocalHost)
+	} else if dualStack {
+		addressType = strings.Replace(addressType, "-", "6-", 1)
+		options += ",ipv6only=0"
+	}
+
+	if port.Limits != nil && port.Limits.MaxConnections > 0 {
+		// Stops accepting connections while reached, leaving them queued on the listen backlog
+		options += fmt.Sprintf(",max-children=%d", port.Limits.MaxConnections)
+	}
+
+	return fmt.Sprintf("%s:%d,%s", addressType, port.LocalPort, options)
+}
+
+// getRemoteTcpChunk returns the socat address for connecting to the remote port,
+// with TLS if enabled for the mapping (OPENSSL:202.54.1.5:443,verify=1,cafile=/certs/ca.crt)
+func getRemoteTcpChunk(port *PortForward) string {
+	if port.TargetTLS == nil {
+		return fmt.Sprintf("TCP:%s:%d", formatHost(port.RemoteHost), port.RemotePort)
+	}
+
+	settings := port.TargetTLS
+	chunk := fmt.Sprintf("OPENSSL:%s:%d", formatHost(port.RemoteHost), port.RemotePort)
+	if settings.InsecureSkipVerify {
+		chunk += ",verify=0"
+	} else {
+		chunk += ",verify=1"
+	}
+	if settings.ServerName != "" {
+		chunk += ",commonname=" + settings.ServerName
+	}
+	if settings.CAFile != "" {
+		chunk += ",cafile=" + settings.CAFile
+	}
+	if settings.CertFile != "" {
+		chunk += fmt.Sprintf(",cert=%s,key=%s", settings.CertFile, settings.KeyFile)
+	}
+	return chunk
+}
+
+func getPortForwardArgs(port *PortForward, dualStack bool) []string {
+	// socat TCP-LISTEN:80,fork TCP:202.54.1.5:80
+	localChunk := getListenChunk(port, dualStack)
+	remoteChunk := getRemoteTcpChunk(port)
+	return []string{localChunk, remoteChunk}
+}
+
+func getPortForwardUdpArgs(port *PortForward, dualStack bool, idleTimeout time.Duration) []string {
+	// socat -T 60 UDP-LISTEN:53,fork,reuseaddr UDP:202.54.1.5:53
+	// (each forked child serves a single client, exiting after being idle for the given timeout)
+	timeoutArgs := []string{"-T", fmt.Sprintf("%g", idleTimeout.Seconds())}
+	localChunk := getListenChunk(port, dualStack)
+	remoteChunk := fmt.Sprintf("UDP:%s:%d", formatHost(port.RemoteHost), port.RemotePort)
+	return append(timeoutArgs, localChunk, remoteChunk)
+}
+
+// socatSupportsProxy returns true if the given proxy can be used by the socat engine
+func socatSupportsProxy(proxy *Proxy) bool {
+	return proxy.Scheme == ProxySchemeSocks4a || proxy.Scheme == ProxySchemeHttp
+}
+
+func getPortForwardProxyArgs(port *PortForward, dualStack bool, proxy *Proxy) []string {
+	localChunk := getListenChunk(port, dualStack)
+	var remoteChunk string
+	if proxy.Scheme == ProxySchemeHttp {
+		// socat TCP-LISTEN:80,fork PROXY:localhost:202.54.1.5:80,proxyport=3128 (being HTTP proxy @ localhost:3128)
+		remoteChunk = fmt.Sprintf("PROXY:%s:%s:%d,proxyport=%d", formatHost(proxy.Host), formatHost(port.RemoteHost), port.RemotePort, proxy.Port)
+		if proxy.Username != "" {
+			remoteChunk += fmt.Sprintf(",proxyauth=%s:%s", proxy.Username, proxy.Password)
+		}
+	} else {
+		// socat TCP-LISTEN:80,fork SOCKS4A:localhost:202.54.1.5:80,socksport=10000 (being proxy @ localhost:10000)
+		remoteChunk = fmt.Sprintf("SOCKS4A:%s:%s:%d,socksport=%d", formatHost(proxy.Host), formatHost(port.RemoteHost), port.RemotePort, proxy.Port)
+	}
+	return []string{localChunk, remoteChunk}
+}
+
+// updateDrainTimeout changes the time given to the socat children to finish when the forwarder is stopped
+func (f *socatForwarder) updateDrainTimeout(timeout time.Duration) {
+	atomic.StoreInt64((*int64)(&f.drainTimeout), int64(timeout))
+}
+
+func (f *socatForwarder) Serve(ctx context.Context) error {
+	var cmdArgs []string
+	if f.port.Protocol == ProtocolUDP {
+		cmdArgs = getPortForwardUdpArgs(f.port, f.dualStack, f.udpIdleTimeout)
+	} else if f.proxy == nil {
+		cmdArgs = getPortForwardArgs(f.port, f.dualStack)
+	} else {
+		cmdArgs = getPortForwardProxyArgs(f.port, f.dualStack, f.proxy)
+	}
+
+	cmd := exec.Command("socat", cmdArgs...)
+	cmd.Stderr = os.Stderr
+	if err := childProcesses.start(cmd); err != nil {
+		return err
+	}
+
+	pgid := cmd.Process.Pid
+	defer childProcesses.remove(pgid)
+	exited := make(chan error, 1)
+	go func() {
+		exited <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-exited:
+		// Kill the children that could remain from the exited socat
+		_ = signalProcessGroup(pgid, syscall.SIGKILL)
+		return err
+	case <-ctx.Done():
+	}
+
+	// Stop accepting new connections by terminating the main socat process;
+	// its forked children keep serving the active connections until they finish
+	_ = cmd.Process.Signal(syscall.SIGTERM)
+	<-exited
+
+	if !waitProcessGroup(pgid, time.Duration(atomic.LoadInt64((*int64)(&f.drainTimeout)))) {
+		_ = signalProcessGroup(pgid, syscall.SIGKILL)
+		return ErrDrainTimeout
+	}
+	return nil
+}
+
+// waitProcessGroup waits for all the processes of the group to exit, up to the given timeout.
+// Returns false if processes remain alive after the timeout.
+func waitProcessGroup(pgid int, timeout time.Duration) bool {
+	deadline := time.Now().Add(timeout)
+	for processGroupAlive(pgid) {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(ProcessGroupPollInterval)
+	}
+	return true
+}
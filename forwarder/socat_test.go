@@ -0,0 +1,78 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSocatArgs(t *testing.T) {
+	port := &PortForward{
+		LocalPort:  8080,
+		RemoteHost: "2001:db8::10",
+		RemotePort: 80,
+		Protocol:   ProtocolTCP,
+	}
+	assert.Equal(t, []string{"TCP-LISTEN:8080,fork", "TCP:[2001:db8::10]:80"}, getPortForwardArgs(port, false))
+	assert.Equal(t, []string{"TCP6-LISTEN:8080,fork,ipv6only=0", "TCP:[2001:db8::10]:80"}, getPortForwardArgs(port, true))
+
+	localPort := &PortForward{
+		LocalHost:  "127.0.0.1",
+		LocalPort:  8080,
+		RemoteHost: "db",
+		RemotePort: 5432,
+		Protocol:   ProtocolTCP,
+	}
+	assert.Equal(t, []string{"TCP4-LISTEN:8080,fork,bind=127.0.0.1", "TCP:db:5432"}, getPortForwardArgs(localPort, true))
+	localPort.LocalHost = "::1"
+	assert.Equal(t, []string{"TCP6-LISTEN:8080,fork,bind=[::1]", "TCP:db:5432"}, getPortForwardArgs(localPort, false))
+	localPort.Protocol = ProtocolUDP
+	assert.Equal(t, []string{"-T", "60", "UDP6-LISTEN:8080,fork,reuseaddr,bind=[::1]", "UDP:db:5432"}, getPortForwardUdpArgs(localPort, true, time.Minute))
+
+	localPort.Protocol = ProtocolTCP
+	localPort.Limits = &ConnectionLimits{MaxConnections: 20, Queue: true}
+	assert.Equal(t, []string{"TCP6-LISTEN:8080,fork,bind=[::1],max-children=20", "TCP:db:5432"}, getPortForwardArgs(localPort, false))
+
+	proxy := &Proxy{Scheme: ProxySchemeSocks4a, Host: "::1", Port: 9050}
+	assert.Equal(t,
+		[]string{"TCP6-LISTEN:8080,fork,ipv6only=0", "SOCKS4A:[::1]:[2001:db8::10]:80,socksport=9050"},
+		getPortForwardProxyArgs(port, true, proxy),
+	)
+
+	httpProxy := &Proxy{Scheme: ProxySchemeHttp, Host: "proxy", Port: 3128, Username: "user", Password: "secret"}
+	assert.Equal(t,
+		[]string{"TCP-LISTEN:8080,fork", "PROXY:proxy:[2001:db8::10]:80,proxyport=3128,proxyauth=user:secret"},
+		getPortForwardProxyArgs(port, false, httpProxy),
+	)
+
+	tlsPort := &PortForward{
+		LocalPort:  5432,
+		RemoteHost: "db.internal",
+		RemotePort: 5432,
+		Protocol:   ProtocolTCP,
+		TargetTLS: &TargetTLS{
+			ServerName: "db.example.com",
+			CAFile:     "/certs/ca.crt",
+			CertFile:   "/certs/client.crt",
+			KeyFile:    "/certs/client.key",
+		},
+	}
+	assert.Equal(t,
+		[]string{"TCP-LISTEN:5432,fork", "OPENSSL:db.internal:5432,verify=1,commonname=db.example.com,cafile=/certs/ca.crt,cert=/certs/client.crt,key=/certs/client.key"},
+		getPortForwardArgs(tlsPort, false),
+	)
+	tlsPort.TargetTLS = &TargetTLS{InsecureSkipVerify: true}
+	assert.Equal(t, []string{"TCP-LISTEN:5432,fork", "OPENSSL:db.internal:5432,verify=0"}, getPortForwardArgs(tlsPort, false))
+
+	udpPort := &PortForward{
+		LocalPort:  53,
+		RemoteHost: "10.0.0.2",
+		RemotePort: 53,
+		Protocol:   ProtocolUDP,
+	}
+	assert.Equal(t,
+		[]string{"-T", "30", "UDP6-LISTEN:53,fork,reuseaddr,ipv6only=0", "UDP:10.0.0.2:53"},
+		getPortForwardUdpArgs(udpPort, true, 30*time.Second),
+	)
+}
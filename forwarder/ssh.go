@@ -0,0 +1,254 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SshKeepAliveInterval is the time between keepalive requests sent on the SSH sessions, for detecting dropped sessions
+const SshKeepAliveInterval = 30 * time.Second
+
+// sshDialer connects to the remote through an SSH server (bastion), opening a direct-tcpip channel for each connection.
+// A single SSH session is used for all the connections, being established again when it drops.
+type sshDialer struct {
+	proxyHop
+	lock   sync.Mutex
+	client *ssh.Client
+}
+
+// sshDialers holds the dialers of each SSH proxy (along with the hops used for reaching it),
+// so the same SSH session is shared by all the port mappings using it, and kept when reloading the settings
+// (until no mapping uses it; see evictSshDialers)
+var sshDialers = struct {
+	lock    sync.Mutex
+	dialers map[string]*sshDialer
+}{dialers: make(map[string]*sshDialer)}
+
+// getSshDialer returns the dialer for the SSH proxy of the given hop, identified by the key
+func getSshDialer(key string, hop proxyHop) *sshDialer {
+	sshDialers.lock.Lock()
+	defer sshDialers.lock.Unlock()
+
+	dialer, ok := sshDialers.dialers[key]
+	if !ok {
+		dialer = &sshDialer{proxyHop: hop}
+		sshDialers.dialers[key] = dialer
+	}
+	return dialer
+}
+
+// evictSshDialers removes the dialers not having their key on the given set (the ones in use),
+// closing their SSH sessions
+func evictSshDialers(used map[string]bool) {
+	sshDialers.lock.Lock()
+	var evicted []*sshDialer
+	for key, dialer := range sshDialers.dialers {
+		if !used[key] {
+			delete(sshDialers.dialers, key)
+			evicted = append(evicted, dialer)
+		}
+	}
+	sshDialers.lock.Unlock()
+
+	for _, dialer := range evicted {
+		dialer.close()
+	}
+}
+
+func (d *sshDialer) DialContext(ctx context.Context, network string, address string) (net.Conn, error) {
+	client, err := d.connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := dialSshChannel(ctx, client, network, address)
+	if _, rejected := err.(*ssh.OpenChannelError); err != nil && !rejected && ctx.Err() == nil {
+		// The session dropped without being noticed yet; establish it again
+		d.disconnect(client)
+		if client, err = d.connect(ctx); err != nil {
+			return nil, err
+		}
+		conn, err = dialSshChannel(ctx, client, network, address)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s could not connect to remote: %s", d.name, err)
+	}
+	return conn, nil
+}
+
+// dialSshChannel opens a direct-tcpip channel to the address, aborting if the context is done before
+func dialSshChannel(ctx context.Context, client *ssh.Client, network string, address string) (net.Conn, error) {
+	type result struct {
+		conn net.Conn
+		err  error
+	}
+	results := make(chan result, 1)
+	go func() {
+		conn, err := client.Dial(network, address)
+		results <- result{conn, err}
+	}()
+
+	select {
+	case r := <-results:
+		return r.conn, r.err
+	case <-ctx.Done():
+		go func() {
+			if r := <-results; r.conn != nil {
+				_ = r.conn.Close()
+			}
+		}()
+		return nil, ctx.Err()
+	}
+}
+
+// connect returns the current SSH session, establishing it if not connected
+func (d *sshDialer) connect(ctx context.Context) (*ssh.Client, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	if d.client != nil {
+		return d.client, nil
+	}
+
+	config, err := d.clientConfig()
+	if err != nil {
+		return nil, fmt.Errorf("invalid settings for %s: %s", d.name, err)
+	}
+
+	proxyAddress := net.JoinHostPort(d.proxy.Host, strconv.Itoa(d.proxy.Port))
+	conn, err := d.forward.DialContext(ctx, "tcp", proxyAddress)
+	if err != nil {
+		if _, ok := d.forward.(*net.Dialer); !ok {
+			// Failed on a previous hop of the chain, already named on the error
+			return nil, err
+		}
+		return nil, fmt.Errorf("could not connect to %s: %s", d.name, err)
+	}
+
+	if deadline, ok := ctx.Deadline(); ok {
+		_ = conn.SetDeadline(deadline)
+	}
+	sshConn, channels, requests, err := ssh.NewClientConn(conn, proxyAddress, config)
+	if err != nil {
+		_ = conn.Close()
+		return nil, fmt.Errorf("handshake with %s failed: %s", d.name, err)
+	}
+	_ = conn.SetDeadline(noDeadline)
+
+	client := ssh.NewClient(sshConn, channels, requests)
+	d.client = client
+	fmt.Printf("Connected to %s\n", d.name)
+
+	closed := make(chan struct{})
+	go d.keepAlive(client, closed)
+	go func() {
+		_ = client.Wait()
+		close(closed)
+		if d.disconnect(client) {
+			fmt.Printf("Session with %s closed, connecting again on the next connection\n", d.name)
+		}
+	}()
+	return client, nil
+}
+
+// disconnect closes the given SSH session, returning true if it was the current one
+func (d *sshDialer) disconnect(client *ssh.Client) bool {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	_ = client.Close()
+	if d.client != client {
+		return false
+	}
+	d.client = nil
+	return true
+}
+
+// close closes the current SSH session, if any
+func (d *sshDialer) close() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.client != nil {
+		_ = d.client.Close()
+		d.client = nil
+		fmt.Printf("Closed session with %s, no longer used\n", d.name)
+	}
+}
+
+// keepAlive sends keepalive requests periodically, closing the SSH session when not replied,
+// until the session is closed
+func (d *sshDialer) keepAlive(client *ssh.Client, closed <-chan struct{}) {
+	ticker := time.NewTicker(SshKeepAliveInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+		case <-closed:
+			return
+		}
+
+		replied := make(chan error, 1)
+		go func() {
+			_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+			replied <- err
+		}()
+
+		select {
+		case err := <-replied:
+			if err == nil {
+				continue
+			}
+		case <-time.After(SshKeepAliveInterval):
+		}
+		d.disconnect(client)
+		return
+	}
+}
+
+func (d *sshDialer) clientConfig() (*ssh.ClientConfig, error) {
+	knownHostsFile := d.proxy.KnownHostsFile
+	if knownHostsFile == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		knownHostsFile = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not read known hosts: %s", err)
+	}
+
+	var auth []ssh.AuthMethod
+	if d.proxy.KeyFile != "" {
+		key, err := os.ReadFile(d.proxy.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not read key: %s", err)
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, fmt.Errorf("could not parse key %s: %s", d.proxy.KeyFile, err)
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if d.proxy.Password != "" {
+		auth = append(auth, ssh.Password(d.proxy.Password))
+	}
+
+	return &ssh.ClientConfig{
+		User:            d.proxy.Username,
+		Auth:            auth,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         DialTimeout,
+	}, nil
+}
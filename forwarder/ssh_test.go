@@ -0,0 +1,262 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// sshTestServer is an SSH server accepting the given password or key, serving direct-tcpip channels
+type sshTestServer struct {
+	port     int
+	hostKey  ssh.PublicKey
+	lock     sync.Mutex
+	sessions []ssh.Conn
+}
+
+func newSshTestSigner(t *testing.T) ssh.Signer {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, err := ssh.NewSignerFromKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return signer
+}
+
+func startSshServer(t *testing.T, password string, clientKey ssh.PublicKey) *sshTestServer {
+	hostSigner := newSshTestSigner(t)
+	config := &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, given []byte) (*ssh.Permissions, error) {
+			if string(given) != password {
+				return nil, fmt.Errorf("wrong password")
+			}
+			return nil, nil
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if clientKey == nil || !bytes.Equal(key.Marshal(), clientKey.Marshal()) {
+				return nil, fmt.Errorf("unknown key")
+			}
+			return nil, nil
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+	server := &sshTestServer{
+		port:    listener.Addr().(*net.TCPAddr).Port,
+		hostKey: hostSigner.PublicKey(),
+	}
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+	return server
+}
+
+func (s *sshTestServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	sshConn, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		return
+	}
+	s.lock.Lock()
+	s.sessions = append(s.sessions, sshConn)
+	s.lock.Unlock()
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		var target struct {
+			Host       string
+			Port       uint32
+			OriginHost string
+			OriginPort uint32
+		}
+		if newChannel.ChannelType() != "direct-tcpip" || ssh.Unmarshal(newChannel.ExtraData(), &target) != nil {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unsupported channel")
+			continue
+		}
+		remote, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+		if err != nil {
+			_ = newChannel.Reject(ssh.ConnectionFailed, err.Error())
+			continue
+		}
+		channel, channelRequests, err := newChannel.Accept()
+		if err != nil {
+			_ = remote.Close()
+			continue
+		}
+		go ssh.DiscardRequests(channelRequests)
+		go func() {
+			defer channel.Close()
+			defer remote.Close()
+			go func() { _, _ = io.Copy(remote, channel) }()
+			_, _ = io.Copy(channel, remote)
+		}()
+	}
+}
+
+// closeSessions drops the established SSH sessions, returning how many there were
+func (s *sshTestServer) closeSessions() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	for _, session := range s.sessions {
+		_ = session.Close()
+	}
+	count := len(s.sessions)
+	s.sessions = nil
+	return count
+}
+
+// writeKnownHosts writes a known_hosts file with the given key for the local server port
+func writeKnownHosts(t *testing.T, port int, key ssh.PublicKey) string {
+	path := filepath.Join(t.TempDir(), "known_hosts")
+	line := knownhosts.Line([]string{knownhosts.Normalize(fmt.Sprintf("127.0.0.1:%d", port))}, key)
+	if err := os.WriteFile(path, []byte(line+"\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestTcpRelaySsh(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+	server := startSshServer(t, "secret", nil)
+
+	startRelay(t, &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+		},
+		dialer: newDialer(&Proxy{
+			Scheme:         ProxySchemeSsh,
+			Host:           "127.0.0.1",
+			Port:           server.port,
+			Username:       "user",
+			Password:       "secret",
+			KnownHostsFile: writeKnownHosts(t, server.port, server.hostKey),
+		}),
+	})
+
+	// The same session is used for all the connections
+	assertEcho(t, localPort, "first")
+	assertEcho(t, localPort, "second")
+	assert.Equal(t, 1, server.closeSessions())
+
+	// The session is established again after dropping
+	time.Sleep(RelayTestThinktime)
+	assertEcho(t, localPort, "after reconnecting")
+	assert.Equal(t, 1, server.closeSessions())
+}
+
+func TestSshDialerKeyAuth(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	_, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientSigner, err := ssh.NewSignerFromKey(clientKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyBlock, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile := filepath.Join(t.TempDir(), "id_ed25519")
+	if err := os.WriteFile(keyFile, pem.EncodeToMemory(keyBlock), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	server := startSshServer(t, "", clientSigner.PublicKey())
+	proxy := &Proxy{
+		Scheme:         ProxySchemeSsh,
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		Username:       "user",
+		KeyFile:        keyFile,
+		KnownHostsFile: writeKnownHosts(t, server.port, server.hostKey),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	conn, err := newDialer(proxy).DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	if assert.Nil(t, err) {
+		_ = conn.Close()
+	}
+
+	// Servers with a different key than the known one are rejected
+	proxy.KnownHostsFile = writeKnownHosts(t, server.port, newSshTestSigner(t).PublicKey())
+	_, err = newDialer(proxy).DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	assert.Contains(t, fmt.Sprint(err), fmt.Sprintf("handshake with ssh proxy 127.0.0.1:%d failed", server.port))
+	assert.Contains(t, fmt.Sprint(err), "key mismatch")
+}
+
+func TestEvictSshDialers(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	server := startSshServer(t, "secret", nil)
+	proxy := &Proxy{
+		Scheme:         ProxySchemeSsh,
+		Host:           "127.0.0.1",
+		Port:           server.port,
+		Username:       "user",
+		Password:       "secret",
+		KnownHostsFile: writeKnownHosts(t, server.port, server.hostKey),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	dialer := newDialer(proxy).(*sshDialer)
+	conn, err := dialer.DialContext(ctx, "tcp", fmt.Sprintf("127.0.0.1:%d", remotePort))
+	if assert.Nil(t, err) {
+		_ = conn.Close()
+	}
+	keys := sshDialerKeys(proxy)
+	assert.Len(t, keys, 1)
+
+	// Reaching the same SSH proxy through another hop uses a different session
+	chainKeys := sshDialerKeys(&Proxy{Scheme: ProxySchemeSocks5, Host: "127.0.0.1", Port: 1080, Next: proxy})
+	assert.Len(t, chainKeys, 1)
+	assert.NotEqual(t, keys[0], chainKeys[0])
+
+	// Kept while in use
+	evictSshDialers(map[string]bool{keys[0]: true})
+	assert.Same(t, dialer, newDialer(proxy))
+	dialer.lock.Lock()
+	assert.NotNil(t, dialer.client)
+	dialer.lock.Unlock()
+
+	// Closing the session when no longer used
+	evictSshDialers(map[string]bool{})
+	dialer.lock.Lock()
+	assert.Nil(t, dialer.client)
+	dialer.lock.Unlock()
+	assert.NotSame(t, dialer, newDialer(proxy))
+	evictSshDialers(nil)
+}
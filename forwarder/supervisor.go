@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// States of a supervised forwarder
+const (
+	StateRunning    = "running"
+	StateRestarting = "restarting"
+	StateFailed     = "failed"
+	StateStopped    = "stopped"
+)
+
+// supervisor runs the forwarder of a port mapping, restarting it with exponential backoff when it stops
+type supervisor struct {
+	port      *PortForward
+	forwarder Forwarder
+	policy    RestartPolicy
+	restarts  int
+	state     string
+	lock      sync.Mutex
+	metrics   *forwardMetrics
+}
+
+func (s *supervisor) setState(state string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.state = state
+}
+
+// status returns the current state of the forwarder, and how many times it was restarted
+func (s *supervisor) status() (state string, restarts int) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.state, s.restarts
+}
+
+// setPolicy changes the restart policy, applied from the next time the forwarder stops
+func (s *supervisor) setPolicy(policy RestartPolicy) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	s.policy = policy
+}
+
+// errMaxRestarts is returned by the supervisor when the forwarder reached the maximum number of consecutive restarts
+type errMaxRestarts struct {
+	port     *PortForward
+	restarts int
+}
+
+func (e *errMaxRestarts) Error() string {
+	return fmt.Sprintf("port forward for mapping %s reached the maximum of %d restarts", e.port.ToString(), e.restarts)
+}
+
+// backoff returns the time to wait before the given restart attempt (starting on 0),
+// growing exponentially up to the policy maximum, and randomized by up to a half (jitter)
+func (p RestartPolicy) backoff(attempt int) time.Duration {
+	backoff := p.Backoff
+	for i := 0; i < attempt && backoff < p.BackoffMax; i++ {
+		backoff *= 2
+	}
+	if backoff > p.BackoffMax {
+		backoff = p.BackoffMax
+	}
+
+	half := int64(backoff / 2)
+	return time.Duration(half + rand.Int63n(half+1))
+}
+
+// Run serves the port mapping until the context is cancelled (returning nil, or ErrDrainTimeout),
+// or the maximum number of restarts is reached (returning errMaxRestarts)
+func (s *supervisor) Run(ctx context.Context) error {
+	if s.metrics == nil {
+		s.metrics = forwardsMetrics.forPort(s.port)
+	}
+
+	attempt := 0
+	for {
+		fmt.Printf("Forwarding port %s ...\n", s.port.ToString())
+		s.setState(StateRunning)
+		startTime := time.Now()
+		err := s.forwarder.Serve(ctx)
+
+		if ctx.Err() != nil {
+			s.setState(StateStopped)
+			if err == ErrDrainTimeout {
+				return err
+			}
+			return nil
+		}
+		if err != nil {
+			fmt.Printf("Port forward for mapping %s failed with error: %s\n", s.port.ToString(), err.Error())
+		} else {
+			fmt.Printf("Port forward for mapping %s closed without error\n", s.port.ToString())
+		}
+
+		s.lock.Lock()
+		policy := s.policy
+		s.lock.Unlock()
+
+		// Reset the backoff and the restarts counted for the maximum if the forwarder was running fine for a while
+		// (the total restarts are kept for the status and metrics)
+		if time.Since(startTime) > policy.BackoffMax {
+			attempt = 0
+		}
+		if policy.MaxRestarts > 0 && attempt >= policy.MaxRestarts {
+			s.setState(StateFailed)
+			return &errMaxRestarts{port: s.port, restarts: attempt}
+		}
+
+		backoff := policy.backoff(attempt)
+		attempt++
+
+		s.lock.Lock()
+		s.state = StateRestarting
+		s.restarts++
+		s.lock.Unlock()
+		atomic.AddInt64(&s.metrics.restarts, 1)
+
+		fmt.Printf("Restarting port forward for mapping %s in %s (restart %d) ...\n", s.port.ToString(), backoff.Round(time.Millisecond), s.restarts)
+		select {
+		case <-ctx.Done():
+			s.setState(StateStopped)
+			return nil
+		case <-time.After(backoff):
+		}
+	}
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// failingForwarder is a Forwarder failing immediately, counting the times it was served
+type failingForwarder struct {
+	serves int
+}
+
+func (f *failingForwarder) Serve(ctx context.Context) error {
+	f.serves++
+	return fmt.Errorf("failure %d", f.serves)
+}
+
+func TestRestartPolicyBackoff(t *testing.T) {
+	policy := RestartPolicy{
+		Backoff:    100 * time.Millisecond,
+		BackoffMax: time.Second,
+	}
+
+	expectedMaxBackoffs := []time.Duration{
+		100 * time.Millisecond,
+		200 * time.Millisecond,
+		400 * time.Millisecond,
+		800 * time.Millisecond,
+		time.Second,
+		time.Second,
+	}
+	for attempt, expectedMax := range expectedMaxBackoffs {
+		backoff := policy.backoff(attempt)
+		assert.GreaterOrEqual(t, int64(backoff), int64(expectedMax/2))
+		assert.LessOrEqual(t, int64(backoff), int64(expectedMax))
+	}
+}
+
+func TestSupervisorMaxRestarts(t *testing.T) {
+	forwarder := &failingForwarder{}
+	s := &supervisor{
+		port:      &PortForward{LocalPort: 8080, RemoteHost: "host1", RemotePort: 80, Protocol: ProtocolTCP},
+		forwarder: forwarder,
+		policy: RestartPolicy{
+			MaxRestarts: 3,
+			Backoff:     time.Millisecond,
+			BackoffMax:  time.Second,
+		},
+	}
+
+	err := s.Run(context.Background())
+	assert.EqualError(t, err, "port forward for mapping 8080:host1:80/tcp reached the maximum of 3 restarts")
+	assert.Equal(t, 4, forwarder.serves)
+}
+
+// slowFailingForwarder is a Forwarder failing after running for a while
+type slowFailingForwarder struct {
+	runFor time.Duration
+}
+
+func (f *slowFailingForwarder) Serve(ctx context.Context) error {
+	time.Sleep(f.runFor)
+	return fmt.Errorf("failure")
+}
+
+func TestSupervisorMaxRestartsReset(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+
+	// Failing after running fine for longer than the maximum backoff does not count for the maximum restarts
+	s := &supervisor{
+		port:      &PortForward{LocalPort: 8080, RemoteHost: "host1", RemotePort: 80, Protocol: ProtocolTCP},
+		forwarder: &slowFailingForwarder{runFor: 10 * time.Millisecond},
+		policy: RestartPolicy{
+			MaxRestarts: 1,
+			Backoff:     time.Millisecond,
+			BackoffMax:  5 * time.Millisecond,
+		},
+	}
+
+	assert.Nil(t, s.Run(ctx))
+	assert.Greater(t, s.restarts, 1)
+}
+
+func TestSupervisorCancel(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	s := &supervisor{
+		port:      &PortForward{LocalPort: 8080, RemoteHost: "host1", RemotePort: 80, Protocol: ProtocolTCP},
+		forwarder: &failingForwarder{},
+		policy: RestartPolicy{
+			Backoff:    time.Millisecond,
+			BackoffMax: 10 * time.Millisecond,
+		},
+	}
+
+	assert.Nil(t, s.Run(ctx))
+	assert.Greater(t, s.restarts, 0)
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	// CertificateWatchInterval is the time between checks for changes on the certificate files
+	CertificateWatchInterval = 2 * time.Second
+	// SelfSignedCertificateValidity is the validity of the self-signed certificates generated at startup
+	SelfSignedCertificateValidity = 10 * 365 * 24 * time.Hour
+	// TLSHandshakeTimeout is the maximum time for clients to complete the TLS handshake
+	TLSHandshakeTimeout = 10 * time.Second
+)
+
+// reloadingCertificate is a certificate loaded from files, being loaded again when they change
+type reloadingCertificate struct {
+	certFile string
+	keyFile  string
+	lock     sync.RWMutex
+	cert     *tls.Certificate
+}
+
+// loadReloadingCertificate loads the certificate from the given files,
+// watching for changes on them until the context is done
+func loadReloadingCertificate(ctx context.Context, certFile string, keyFile string) (*reloadingCertificate, error) {
+	c := &reloadingCertificate{
+		certFile: certFile,
+		keyFile:  keyFile,
+	}
+	if err := c.load(); err != nil {
+		return nil, err
+	}
+
+	certChanges := watchFile(ctx, certFile, CertificateWatchInterval)
+	keyChanges := watchFile(ctx, keyFile, CertificateWatchInterval)
+	go func() {
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-certChanges:
+			case <-keyChanges:
+			}
+
+			// Both files can be changed at different times; the certificate is kept until matching the key
+			if err := c.load(); err != nil {
+				fmt.Printf("Could not reload certificate %s, keeping the current one: %s\n", certFile, err)
+				continue
+			}
+			fmt.Printf("Reloaded certificate %s\n", certFile)
+		}
+	}()
+	return c, nil
+}
+
+func (c *reloadingCertificate) load() error {
+	cert, err := tls.LoadX509KeyPair(c.certFile, c.keyFile)
+	if err != nil {
+		return err
+	}
+
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.cert = &cert
+	return nil
+}
+
+func (c *reloadingCertificate) getCertificate(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.cert, nil
+}
+
+// generateSelfSignedCertificate returns a new self-signed certificate, valid for localhost and the container hostname
+func generateSelfSignedCertificate() (*tls.Certificate, error) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+
+	names := []string{"localhost"}
+	if hostname, err := os.Hostname(); err == nil && hostname != "localhost" {
+		names = append(names, hostname)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: names[len(names)-1]},
+		DNSNames:              names,
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1), net.IPv6loopback},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(SelfSignedCertificateValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return nil, err
+	}
+	return &tls.Certificate{
+		Certificate: [][]byte{der},
+		PrivateKey:  key,
+	}, nil
+}
+
+// newListenerTLSConfig returns the TLS config for serving the local port with the given settings.
+// Certificate files are watched for changes until the context is done.
+func newListenerTLSConfig(ctx context.Context, settings *ListenTLS) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+
+	if settings.ClientCAFile != "" {
+		var err error
+		if config.ClientCAs, err = loadCertPool(settings.ClientCAFile); err != nil {
+			return nil, fmt.Errorf("could not load client CA: %s", err)
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+		if len(settings.AllowedNames) > 0 {
+			config.VerifyConnection = func(state tls.ConnectionState) error {
+				return verifyClientName(state.PeerCertificates[0], settings.AllowedNames)
+			}
+		}
+	}
+
+	if settings.CertFile == "" {
+		cert, err := generateSelfSignedCertificate()
+		if err != nil {
+			return nil, fmt.Errorf("could not generate self-signed certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{*cert}
+		return config, nil
+	}
+
+	cert, err := loadReloadingCertificate(ctx, settings.CertFile, settings.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("could not load certificate: %s", err)
+	}
+	config.GetCertificate = cert.getCertificate
+	return config, nil
+}
+
+// loadCertPool loads the PEM certificates from the given file
+func loadCertPool(path string) (*x509.CertPool, error) {
+	certsPem, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certsPem) {
+		return nil, fmt.Errorf("no certificates found on %s", path)
+	}
+	return pool, nil
+}
+
+// verifyClientName returns an error if neither the CN nor any SAN (DNS, IP, email or URI) of the certificate are allowed
+func verifyClientName(cert *x509.Certificate, allowedNames []string) error {
+	names := []string{cert.Subject.CommonName}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+
+	for _, name := range names {
+		for _, allowed := range allowedNames {
+			if name != "" && name == allowed {
+				return nil
+			}
+		}
+	}
+	return fmt.Errorf("client certificate \"%s\" not allowed", cert.Subject.CommonName)
+}
+
+// newTargetTLSConfig returns the TLS config for connecting to the remote of the given port mapping
+func newTargetTLSConfig(port *PortForward) (*tls.Config, error) {
+	settings := port.TargetTLS
+	config := &tls.Config{
+		ServerName:         settings.ServerName,
+		InsecureSkipVerify: settings.InsecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if config.ServerName == "" {
+		config.ServerName = port.RemoteHost
+	}
+
+	if settings.CAFile != "" {
+		var err error
+		if config.RootCAs, err = loadCertPool(settings.CAFile); err != nil {
+			return nil, fmt.Errorf("could not load CA: %s", err)
+		}
+	}
+
+	if settings.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(settings.CertFile, settings.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("could not load client certificate: %s", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// tlsHandshakeRemote starts TLS on the connection to the remote, closing it if the handshake fails
+func tlsHandshakeRemote(ctx context.Context, remote net.Conn, config *tls.Config) (net.Conn, error) {
+	tlsRemote := tls.Client(remote, config)
+	if err := tlsRemote.HandshakeContext(ctx); err != nil {
+		_ = remote.Close()
+		return nil, fmt.Errorf("TLS handshake failed: %s", err)
+	}
+	return tlsRemote, nil
+}
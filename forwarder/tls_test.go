@@ -0,0 +1,374 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// writeCertificate writes a new self-signed certificate and its key to the given files
+func writeCertificate(t *testing.T, certFile string, keyFile string) *x509.Certificate {
+	cert, err := generateSelfSignedCertificate()
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := x509.MarshalPKCS8PrivateKey(cert.PrivateKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPem := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: cert.Certificate[0]})
+	keyPem := pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: key})
+	if err := os.WriteFile(certFile, certPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyFile, keyPem, 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	parsed, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return parsed
+}
+
+// assertTLSEcho connects with TLS to the local port, checking the echoed message, and returning the server certificate
+func assertTLSEcho(t *testing.T, port int64, message string) *x509.Certificate {
+	conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port), &tls.Config{InsecureSkipVerify: true})
+	if !assert.Nil(t, err) {
+		return nil
+	}
+	defer conn.Close()
+
+	_, err = fmt.Fprintf(conn, "%s\n", message)
+	assert.Nil(t, err)
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := bufio.NewReader(conn).ReadString('\n')
+	assert.Nil(t, err)
+	assert.Equal(t, message+"\n", reply)
+	return conn.ConnectionState().PeerCertificates[0]
+}
+
+func TestTcpRelayListenTLS(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+
+	t.Run("self-signed", func(t *testing.T) {
+		localPort := getFreePort(t)
+		startRelay(t, &tcpRelay{
+			port: &PortForward{
+				LocalPort:  localPort,
+				RemoteHost: "127.0.0.1",
+				RemotePort: remotePort,
+				ListenTLS:  &ListenTLS{},
+			},
+			dialer: newDialer(nil),
+		})
+
+		cert := assertTLSEcho(t, localPort, "decrypted")
+		assert.Contains(t, cert.DNSNames, "localhost")
+	})
+
+	t.Run("files", func(t *testing.T) {
+		dir := t.TempDir()
+		certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+		expectedCert := writeCertificate(t, certFile, keyFile)
+
+		localPort := getFreePort(t)
+		startRelay(t, &tcpRelay{
+			port: &PortForward{
+				LocalPort:  localPort,
+				RemoteHost: "127.0.0.1",
+				RemotePort: remotePort,
+				ListenTLS:  &ListenTLS{CertFile: certFile, KeyFile: keyFile},
+			},
+			dialer: newDialer(nil),
+		})
+
+		cert := assertTLSEcho(t, localPort, "decrypted")
+		assert.Equal(t, expectedCert.SerialNumber, cert.SerialNumber)
+	})
+
+	t.Run("restarted", func(t *testing.T) {
+		// Listening on a port already in use fails
+		busyPort := getFreePort(t)
+		listener, err := net.Listen("tcp", fmt.Sprintf(":%d", busyPort))
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer listener.Close()
+
+		relay := &tcpRelay{
+			port: &PortForward{
+				LocalPort:  busyPort,
+				RemoteHost: "127.0.0.1",
+				RemotePort: remotePort,
+				ListenTLS:  &ListenTLS{},
+			},
+			dialer: newDialer(nil),
+		}
+		assert.NotNil(t, relay.Serve(context.Background()))
+		config := relay.listenTLS
+		assert.NotNil(t, config)
+
+		// The TLS config (and its self-signed certificate) is kept when serving again
+		assert.NotNil(t, relay.Serve(context.Background()))
+		assert.Same(t, config, relay.listenTLS)
+	})
+}
+
+func TestReloadingCertificate(t *testing.T) {
+	dir := t.TempDir()
+	certFile, keyFile := filepath.Join(dir, "tls.crt"), filepath.Join(dir, "tls.key")
+	writeCertificate(t, certFile, keyFile)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reloading, err := loadReloadingCertificate(ctx, certFile, keyFile)
+	if !assert.Nil(t, err) {
+		return
+	}
+
+	// Changed files are loaded again
+	newCert := writeCertificate(t, certFile, keyFile)
+	assert.Eventually(t, func() bool {
+		cert, _ := reloading.getCertificate(nil)
+		return string(cert.Certificate[0]) == string(newCert.Raw)
+	}, 3*CertificateWatchInterval, RelayTestThinktime)
+
+	// The current certificate is kept if the new files are not valid
+	assert.Nil(t, os.WriteFile(certFile, []byte("invalid"), 0600))
+	assert.NotNil(t, reloading.load())
+	cert, _ := reloading.getCertificate(nil)
+	assert.Equal(t, newCert.Raw, cert.Certificate[0])
+}
+
+// startTLSEchoServer starts a TLS server with the given certificate files, replying back everything received,
+// returning its port, and a channel receiving the client certificates
+func startTLSEchoServer(t *testing.T, certFile string, keyFile string) (int64, <-chan []*x509.Certificate) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientAuth:   tls.RequestClientCert,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = listener.Close() })
+
+	clientCerts := make(chan []*x509.Certificate, 10)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tlsConn := conn.(*tls.Conn)
+				if tlsConn.Handshake() != nil {
+					return
+				}
+				clientCerts <- tlsConn.ConnectionState().PeerCertificates
+				_, _ = io.Copy(conn, conn)
+			}()
+		}
+	}()
+
+	return int64(listener.Addr().(*net.TCPAddr).Port), clientCerts
+}
+
+func TestTcpRelayTargetTLS(t *testing.T) {
+	dir := t.TempDir()
+	serverCertFile, serverKeyFile := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	writeCertificate(t, serverCertFile, serverKeyFile)
+	clientCertFile, clientKeyFile := filepath.Join(dir, "client.crt"), filepath.Join(dir, "client.key")
+	clientCert := writeCertificate(t, clientCertFile, clientKeyFile)
+	remotePort, clientCerts := startTLSEchoServer(t, serverCertFile, serverKeyFile)
+
+	startTargetTLSRelay := func(targetTLS *TargetTLS) int64 {
+		localPort := getFreePort(t)
+		startRelay(t, &tcpRelay{
+			port: &PortForward{
+				LocalPort:  localPort,
+				RemoteHost: "127.0.0.1",
+				RemotePort: remotePort,
+				TargetTLS:  targetTLS,
+			},
+			dialer: newDialer(nil),
+		})
+		return localPort
+	}
+
+	// Verified with the given CA, and authenticated with the client certificate
+	localPort := startTargetTLSRelay(&TargetTLS{
+		ServerName: "localhost",
+		CAFile:     serverCertFile,
+		CertFile:   clientCertFile,
+		KeyFile:    clientKeyFile,
+	})
+	assertEcho(t, localPort, "encrypted")
+	if certs := <-clientCerts; assert.Len(t, certs, 1) {
+		assert.Equal(t, clientCert.Raw, certs[0].Raw)
+	}
+
+	// Not verified
+	localPort = startTargetTLSRelay(&TargetTLS{InsecureSkipVerify: true})
+	assertEcho(t, localPort, "encrypted")
+
+	// Verification failed (unknown CA), closing the client connection
+	localPort = startTargetTLSRelay(&TargetTLS{})
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort))
+	if !assert.Nil(t, err) {
+		return
+	}
+	defer conn.Close()
+	_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+	_, err = conn.Read(make([]byte, 1))
+	assert.Equal(t, io.EOF, err)
+}
+
+// testCA issues certificates for tests
+type testCA struct {
+	cert *x509.Certificate
+	key  *ecdsa.PrivateKey
+}
+
+func newTestCA(t *testing.T) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testCA{cert: cert, key: key}
+}
+
+// writeCertificate writes the CA certificate on a new file, returning its path
+func (ca *testCA) writeCertificate(t *testing.T) string {
+	path := filepath.Join(t.TempDir(), "ca.crt")
+	if err := os.WriteFile(path, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.cert.Raw}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// issueClientCertificate returns a new client certificate signed by the CA
+func (ca *testCA) issueClientCertificate(t *testing.T, commonName string, dnsNames ...string) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: commonName},
+		DNSNames:     dnsNames,
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestTcpRelayListenMutualTLS(t *testing.T) {
+	remotePort := startEchoServer(t, "127.0.0.1")
+	localPort := getFreePort(t)
+	ca := newTestCA(t)
+	relay := &tcpRelay{
+		port: &PortForward{
+			LocalPort:  localPort,
+			RemoteHost: "127.0.0.1",
+			RemotePort: remotePort,
+			ListenTLS: &ListenTLS{
+				ClientCAFile: ca.writeCertificate(t),
+				AllowedNames: []string{"allowed.example.com"},
+			},
+		},
+		dialer:  newDialer(nil),
+		metrics: &forwardMetrics{}, // read by the test while serving
+	}
+	startRelay(t, relay)
+
+	echo := func(certs ...tls.Certificate) error {
+		conn, err := tls.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", localPort), &tls.Config{
+			InsecureSkipVerify: true,
+			Certificates:       certs,
+		})
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+
+		// With TLS 1.3, client certificates are rejected after the client completes the handshake
+		if _, err := fmt.Fprintf(conn, "ping\n"); err != nil {
+			return err
+		}
+		_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+		_, err = bufio.NewReader(conn).ReadString('\n')
+		return err
+	}
+
+	// Allowed by SAN
+	assert.Nil(t, echo(ca.issueClientCertificate(t, "client", "allowed.example.com")))
+	assert.Equal(t, int64(0), atomic.LoadInt64(&relay.metrics.tlsHandshakeErrors))
+
+	// Not allowed name, not signed by the CA, and without certificate
+	assert.NotNil(t, echo(ca.issueClientCertificate(t, "other.example.com")))
+	assert.NotNil(t, echo(newTestCA(t).issueClientCertificate(t, "allowed.example.com")))
+	assert.NotNil(t, echo())
+	assert.Eventually(t, func() bool {
+		return atomic.LoadInt64(&relay.metrics.tlsHandshakeErrors) == 3
+	}, time.Second, RelayTestThinktime/10)
+}
+
+func TestVerifyClientName(t *testing.T) {
+	cert := &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		DNSNames:    []string{"client.example.com"},
+		IPAddresses: []net.IP{net.ParseIP("10.0.0.1")},
+	}
+	assert.Nil(t, verifyClientName(cert, []string{"client"}))
+	assert.Nil(t, verifyClientName(cert, []string{"other", "client.example.com"}))
+	assert.Nil(t, verifyClientName(cert, []string{"10.0.0.1"}))
+	assert.EqualError(t, verifyClientName(cert, []string{"other"}), "client certificate \"client\" not allowed")
+}
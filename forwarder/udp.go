@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	UdpMaxDatagramSize = 65535
+	// UdpDeniedLogInterval is the minimum time between logging the denied datagrams of the same client IP
+	UdpDeniedLogInterval = time.Minute
+)
+
+// udpRelay forwards a single UDP port mapping from within the current process.
+// Each client address gets its own session (and outbound socket), closed after being idle for a while.
+type udpRelay struct {
+	port        *PortForward
+	access      []*AccessRule
+	idleTimeout time.Duration
+	metrics     *forwardMetrics
+
+	listener net.PacketConn
+	sessions map[string]*udpSession
+	lock     sync.Mutex
+	running  sync.WaitGroup // session goroutines
+
+	deniedLogged map[string]time.Time // by client IP; only used by the Serve loop
+	deniedPruned time.Time
+}
+
+// udpSession relays the datagrams of a single client address
+type udpSession struct {
+	client       net.Addr
+	remote       net.Conn
+	lastActivity int64 // unix nanoseconds, accessed atomically
+	finished     func()
+}
+
+func (s *udpSession) touch() {
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+}
+
+func (s *udpSession) idleSince() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&s.lastActivity))
+}
+
+func (r *udpRelay) Serve(ctx context.Context) error {
+	if r.metrics == nil {
+		r.metrics = forwardsMetrics.forPort(r.port)
+	}
+
+	listener, err := net.ListenPacket("udp", r.port.listenAddress())
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	r.listener = listener
+	r.sessions = make(map[string]*udpSession)
+	r.deniedLogged = make(map[string]time.Time)
+
+	go func() {
+		<-ctx.Done()
+		_ = listener.Close()
+	}()
+	defer r.closeSessions()
+
+	buffer := make([]byte, UdpMaxDatagramSize)
+	for {
+		n, client, err := listener.ReadFrom(buffer)
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
+				continue
+			}
+			return err
+		}
+
+		if !accessAllowed(r.access, client) {
+			atomic.AddInt64(&r.metrics.deniedConnections, 1)
+			r.logDenied(client)
+			continue
+		}
+
+		session, err := r.getSession(ctx, client)
+		if err != nil {
+			fmt.Printf("Port forward %s could not reach remote: %s\n", r.port.ToString(), err)
+			continue
+		}
+
+		session.touch()
+		n, _ = session.remote.Write(buffer[:n])
+		atomic.AddInt64(&r.metrics.bytesIn, int64(n))
+	}
+}
+
+// logDenied logs a datagram denied by the access rules, unless already logged for the client IP within UdpDeniedLogInterval
+// (a denied client may keep sending datagrams, unlike connections). Returns true if logged.
+func (r *udpRelay) logDenied(client net.Addr) bool {
+	now := time.Now()
+	if now.Sub(r.deniedPruned) > UdpDeniedLogInterval {
+		for ip, logged := range r.deniedLogged {
+			if now.Sub(logged) >= UdpDeniedLogInterval {
+				delete(r.deniedLogged, ip)
+			}
+		}
+		r.deniedPruned = now
+	}
+
+	ip := clientIp(client)
+	if logged, ok := r.deniedLogged[ip]; ok && now.Sub(logged) < UdpDeniedLogInterval {
+		return false
+	}
+	r.deniedLogged[ip] = now
+	fmt.Printf("Port forward %s denied datagrams from %s (logged once per %s)\n", r.port.ToString(), client, UdpDeniedLogInterval)
+	return true
+}
+
+// getSession returns the session for the given client address, creating it if not exists
+func (r *udpRelay) getSession(ctx context.Context, client net.Addr) (*udpSession, error) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := client.String()
+	if session, ok := r.sessions[key]; ok {
+		return session, nil
+	}
+
+	remoteAddress := net.JoinHostPort(r.port.RemoteHost, fmt.Sprintf("%d", r.port.RemotePort))
+	dialer := &net.Dialer{Timeout: DialTimeout}
+	dialStart := time.Now()
+	remote, err := dialer.DialContext(ctx, "udp", remoteAddress)
+	r.metrics.observeDial(dialStart, err)
+	if err != nil {
+		return nil, err
+	}
+
+	session := &udpSession{
+		client:   client,
+		remote:   remote,
+		finished: r.metrics.connectionStarted(),
+	}
+	session.touch()
+	r.sessions[key] = session
+
+	r.running.Add(1)
+	go r.serveSession(r.listener, session)
+	return session, nil
+}
+
+// serveSession relays the replies from the remote back to the client, until the session is idle or closed
+func (r *udpRelay) serveSession(listener net.PacketConn, session *udpSession) {
+	defer r.running.Done()
+	defer r.closeSession(session)
+
+	buffer := make([]byte, UdpMaxDatagramSize)
+	for {
+		_ = session.remote.SetReadDeadline(session.idleSince().Add(r.idleTimeout))
+		n, err := session.remote.Read(buffer)
+		if err != nil {
+			if netErr, ok := err.(net.Error); ok && netErr.Timeout() && time.Since(session.idleSince()) < r.idleTimeout {
+				// The client sent data meanwhile, keep waiting
+				continue
+			}
+			return
+		}
+
+		session.touch()
+		n, _ = listener.WriteTo(buffer[:n], session.client)
+		atomic.AddInt64(&r.metrics.bytesOut, int64(n))
+	}
+}
+
+func (r *udpRelay) closeSession(session *udpSession) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	key := session.client.String()
+	if r.sessions[key] == session {
+		delete(r.sessions, key)
+	}
+	_ = session.remote.Close()
+	session.finished()
+}
+
+func (r *udpRelay) closeSessions() {
+	r.lock.Lock()
+	for _, session := range r.sessions {
+		_ = session.remote.Close()
+	}
+	r.lock.Unlock()
+
+	// Wait for the sessions to finish, so they are not left writing to the listener when serving again
+	r.running.Wait()
+}